@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/yankeguo/fastci"
 	"github.com/yankeguo/rg"
@@ -21,16 +25,46 @@ func main() {
 			return
 		}
 		log.Println("exited with error:", err.Error())
+
+		// conventional exit code 128+n for signal n, 130 for SIGINT, 143 for SIGTERM
+		var se *fastci.SignalError
+		if errors.As(err, &se) {
+			if sig, ok := se.Signal.(syscall.Signal); ok {
+				os.Exit(128 + int(sig))
+			}
+		}
 		os.Exit(1)
 	}()
 	defer rg.Guard(&err)
 
 	var (
-		optFile string
+		optFile    string
+		optTimeout time.Duration
 	)
 	flag.StringVar(&optFile, "f", fileStdin, "fastci script file to read, - for stdin")
+	flag.DurationVar(&optTimeout, "timeout", 0, "timeout of the whole pipeline, for example 30m, 0 for no timeout")
 	flag.Parse()
 
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// stop the pipeline on signals
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	go func() {
+		sig := <-signals
+		log.Println("received signal:", sig.String())
+		cancel(&fastci.SignalError{Signal: sig})
+	}()
+
+	if optTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, optTimeout)
+		defer cancelTimeout()
+	}
+
 	var f *os.File
 	if optFile == fileStdin {
 		f = os.Stdin
@@ -39,5 +73,5 @@ func main() {
 		defer f.Close()
 	}
 
-	rg.Must0(fastci.NewRunner().Execute(context.Background(), f))
+	rg.Must0(fastci.NewRunner().Execute(ctx, f))
 }
@@ -0,0 +1,105 @@
+package fastforge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type coding struct {
+	client
+}
+
+func (c *coding) auth(req *http.Request) {
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.token)
+	} else {
+		req.Header.Set("Authorization", "token "+c.token)
+	}
+}
+
+type codingError struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+// invoke calls an action of coding.net open api, errors are returned in the body with status 200
+func (c *coding) invoke(ctx context.Context, action string, body map[string]any, out any) (err error) {
+	body["Action"] = action
+
+	var res struct {
+		Response json.RawMessage `json:"Response"`
+	}
+	if err = c.do(ctx, http.MethodPost, c.apiURL+"?Action="+url.QueryEscape(action), c.auth, body, &res); err != nil {
+		return
+	}
+
+	var inner struct {
+		Error *codingError `json:"Error"`
+	}
+	if err = json.Unmarshal(res.Response, &inner); err != nil {
+		return
+	}
+	if inner.Error != nil {
+		err = fmt.Errorf("coding api error: %s: %s", inner.Error.Code, inner.Error.Message)
+		return
+	}
+	if out != nil {
+		err = json.Unmarshal(res.Response, out)
+	}
+	return
+}
+
+// webURL returns the web url of the merge request, on the host of api url
+func (c *coding) webURL(id int64) string {
+	splits := strings.Split(c.repo, "/")
+	if len(splits) != 3 {
+		return ""
+	}
+	u, err := url.Parse(c.apiURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	base := u.Scheme + "://" + u.Host
+	if strings.EqualFold(u.Host, "e.coding.net") {
+		// the web pages of coding.net are served on the team domain
+		base = "https://" + splits[0] + ".coding.net"
+	}
+	return fmt.Sprintf("%s/p/%s/d/%s/git/merge/%d", base, splits[1], splits[2], id)
+}
+
+func (c *coding) CreateMergeRequest(ctx context.Context, req MergeRequest) (mr MergeRequestResult, err error) {
+	var res struct {
+		MergeInfo struct {
+			MergeId int64 `json:"MergeId"`
+		} `json:"MergeInfo"`
+	}
+	if err = c.invoke(ctx, "CreateGitMergeRequest", map[string]any{
+		"DepotPath":  c.repo,
+		"Title":      req.Title,
+		"Content":    req.Description,
+		"SrcBranch":  req.SourceBranch,
+		"DestBranch": req.TargetBranch,
+	}, &res); err != nil {
+		return
+	}
+	if res.MergeInfo.MergeId == 0 {
+		err = errors.New("coding api error: missing MergeId in response")
+		return
+	}
+	mr = MergeRequestResult{Number: res.MergeInfo.MergeId, URL: c.webURL(res.MergeInfo.MergeId)}
+	return
+}
+
+// EnableAutoMerge merges the merge request immediately, since coding.net has no auto merge
+func (c *coding) EnableAutoMerge(ctx context.Context, mr MergeRequestResult) (err error) {
+	return c.invoke(ctx, "MergeGitMergeRequest", map[string]any{
+		"DepotPath":          c.repo,
+		"MergeId":            mr.Number,
+		"DeleteSourceBranch": true,
+	}, nil)
+}
@@ -0,0 +1,184 @@
+package fastforge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	KindGitHub = "github"
+	KindGitLab = "gitlab"
+	KindGitea  = "gitea"
+	KindCoding = "coding"
+)
+
+// MergeRequest is the request to open a merge request (or pull request)
+type MergeRequest struct {
+	SourceBranch string
+	TargetBranch string
+	Title        string
+	Description  string
+}
+
+// MergeRequestResult is an opened merge request
+type MergeRequestResult struct {
+	// Number is the number (or iid) of the merge request in the repository
+	Number int64
+	// NodeID is the global id of the merge request, only for GitHub
+	NodeID string
+	// URL is the web url of the merge request
+	URL string
+}
+
+// Forge is a git forge which supports merge requests
+type Forge interface {
+	// CreateMergeRequest opens a new merge request
+	CreateMergeRequest(ctx context.Context, req MergeRequest) (MergeRequestResult, error)
+	// EnableAutoMerge merges once checks pass, or immediately
+	EnableAutoMerge(ctx context.Context, mr MergeRequestResult) error
+}
+
+// Options are options for creating a Forge
+type Options struct {
+	// Kind is one of github, gitlab, gitea and coding
+	Kind string
+	// APIURL is the base url of the REST API, for example https://gitlab.example.com/api/v4
+	APIURL string
+	// Repo is the full path, like owner/repo
+	Repo string
+	// Username is used for basic authentication by coding.net
+	Username string
+	// Token is the access token
+	Token string
+}
+
+// DetectKind guesses the kind of forge from the host, returns empty if unknown
+func DetectKind(host string) string {
+	host = strings.ToLower(host)
+	switch {
+	case host == "github.com" || strings.HasPrefix(host, "github."):
+		return KindGitHub
+	case host == "gitlab.com" || strings.Contains(host, "gitlab"):
+		return KindGitLab
+	case host == "codeberg.org" || strings.Contains(host, "gitea") || strings.Contains(host, "forgejo"):
+		return KindGitea
+	case host == "e.coding.net" || strings.HasSuffix(host, ".coding.net"):
+		return KindCoding
+	}
+	return ""
+}
+
+// DefaultAPIURL returns the default REST API url of the forge at host
+func DefaultAPIURL(kind string, host string) string {
+	switch kind {
+	case KindGitHub:
+		if host == "github.com" {
+			return "https://api.github.com"
+		}
+		return "https://" + host + "/api/v3"
+	case KindGitLab:
+		return "https://" + host + "/api/v4"
+	case KindGitea:
+		return "https://" + host + "/api/v1"
+	case KindCoding:
+		return "https://" + host + "/open-api"
+	}
+	return ""
+}
+
+// New creates a Forge with options
+func New(opts Options) (f Forge, err error) {
+	if opts.APIURL == "" {
+		err = errors.New("forge api url is not set")
+		return
+	}
+	if opts.Repo == "" {
+		err = errors.New("forge repository is not set")
+		return
+	}
+	c := client{
+		apiURL:   strings.TrimSuffix(opts.APIURL, "/"),
+		repo:     strings.TrimSuffix(strings.Trim(opts.Repo, "/"), ".git"),
+		username: opts.Username,
+		token:    opts.Token,
+	}
+	switch opts.Kind {
+	case KindGitHub:
+		f = &github{c}
+	case KindGitLab:
+		f = &gitlab{c}
+	case KindGitea:
+		f = &gitea{c}
+	case KindCoding:
+		f = &coding{c}
+	default:
+		err = fmt.Errorf("unsupported forge: %q", opts.Kind)
+	}
+	return
+}
+
+// StatusError is returned when the forge API responds with a non-2xx status code
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("forge api error: %d %s: %s", e.Code, http.StatusText(e.Code), strings.TrimSpace(e.Body))
+}
+
+type client struct {
+	apiURL   string
+	repo     string
+	username string
+	token    string
+}
+
+// do sends a JSON request, auth is invoked to set authentication headers
+func (c client) do(ctx context.Context, method string, u string, auth func(req *http.Request), body any, out any) (err error) {
+	var reqBody io.Reader
+	if body != nil {
+		var buf []byte
+		if buf, err = json.Marshal(body); err != nil {
+			return
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, method, u, reqBody); err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	auth(req)
+
+	var res *http.Response
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	var buf []byte
+	if buf, err = io.ReadAll(res.Body); err != nil {
+		return
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		err = &StatusError{Code: res.StatusCode, Body: string(buf)}
+		return
+	}
+
+	if out != nil && len(buf) > 0 {
+		err = json.Unmarshal(buf, out)
+	}
+	return
+}
@@ -0,0 +1,172 @@
+package fastforge
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordedRequest struct {
+	Method string
+	URI    string
+	Header http.Header
+	Body   map[string]any
+}
+
+// newForgeServerForTest responds by "METHOD URI" and records requests
+func newForgeServerForTest(t *testing.T, responses map[string]string) (*httptest.Server, *[]recordedRequest) {
+	var records []recordedRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := io.ReadAll(r.Body)
+		rec := recordedRequest{Method: r.Method, URI: r.URL.RequestURI(), Header: r.Header}
+		json.Unmarshal(buf, &rec.Body)
+		records = append(records, rec)
+
+		res, ok := responses[r.Method+" "+r.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(res))
+	}))
+	t.Cleanup(s.Close)
+	return s, &records
+}
+
+var testMergeRequest = MergeRequest{
+	SourceBranch: "fastci/app-1",
+	TargetBranch: "main",
+	Title:        "update values",
+	Description:  "created by fastci",
+}
+
+func TestGitHub(t *testing.T) {
+	s, records := newForgeServerForTest(t, map[string]string{
+		"POST /api/v3/repos/owner/repo/pulls": `{"number": 7, "node_id": "PR_7", "html_url": "https://github.example.com/owner/repo/pull/7"}`,
+		"POST /api/graphql":                   `{"data": {}}`,
+	})
+
+	f, err := New(Options{Kind: KindGitHub, APIURL: s.URL + "/api/v3", Repo: "owner/repo.git", Token: "secret"})
+	require.NoError(t, err)
+
+	mr, err := f.CreateMergeRequest(context.Background(), testMergeRequest)
+	require.NoError(t, err)
+	require.Equal(t, "https://github.example.com/owner/repo/pull/7", mr.URL)
+
+	require.NoError(t, f.EnableAutoMerge(context.Background(), mr))
+
+	require.Len(t, *records, 2)
+	require.Equal(t, "Bearer secret", (*records)[0].Header.Get("Authorization"))
+	require.Equal(t, "fastci/app-1", (*records)[0].Body["head"])
+	require.Equal(t, "main", (*records)[0].Body["base"])
+	require.Equal(t, map[string]any{"id": "PR_7"}, (*records)[1].Body["variables"])
+}
+
+func TestGitHubAutoMergeError(t *testing.T) {
+	s, _ := newForgeServerForTest(t, map[string]string{
+		"POST /graphql": `{"errors": [{"message": "auto merge is not allowed"}]}`,
+	})
+
+	f, err := New(Options{Kind: KindGitHub, APIURL: s.URL, Repo: "owner/repo", Token: "secret"})
+	require.NoError(t, err)
+
+	err = f.EnableAutoMerge(context.Background(), MergeRequestResult{NodeID: "PR_7"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "auto merge is not allowed")
+}
+
+func TestGitLab(t *testing.T) {
+	s, records := newForgeServerForTest(t, map[string]string{
+		"POST /api/v4/projects/group%2Fsub%2Frepo/merge_requests":        `{"iid": 3, "web_url": "https://gitlab.example.com/group/sub/repo/-/merge_requests/3"}`,
+		"PUT /api/v4/projects/group%2Fsub%2Frepo/merge_requests/3/merge": `{}`,
+	})
+
+	f, err := New(Options{Kind: KindGitLab, APIURL: s.URL + "/api/v4/", Repo: "group/sub/repo", Token: "secret"})
+	require.NoError(t, err)
+
+	mr, err := f.CreateMergeRequest(context.Background(), testMergeRequest)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), mr.Number)
+	require.Equal(t, "https://gitlab.example.com/group/sub/repo/-/merge_requests/3", mr.URL)
+
+	require.NoError(t, f.EnableAutoMerge(context.Background(), mr))
+
+	require.Len(t, *records, 2)
+	require.Equal(t, "secret", (*records)[0].Header.Get("PRIVATE-TOKEN"))
+	require.Equal(t, "fastci/app-1", (*records)[0].Body["source_branch"])
+	require.Equal(t, true, (*records)[1].Body["merge_when_pipeline_succeeds"])
+}
+
+func TestGitea(t *testing.T) {
+	s, records := newForgeServerForTest(t, map[string]string{
+		"POST /api/v1/repos/owner/repo/pulls":         `{"number": 5, "html_url": "https://gitea.example.com/owner/repo/pulls/5"}`,
+		"POST /api/v1/repos/owner/repo/pulls/5/merge": ``,
+	})
+
+	f, err := New(Options{Kind: KindGitea, APIURL: s.URL + "/api/v1", Repo: "owner/repo", Token: "secret"})
+	require.NoError(t, err)
+
+	mr, err := f.CreateMergeRequest(context.Background(), testMergeRequest)
+	require.NoError(t, err)
+	require.Equal(t, "https://gitea.example.com/owner/repo/pulls/5", mr.URL)
+
+	require.NoError(t, f.EnableAutoMerge(context.Background(), mr))
+
+	require.Len(t, *records, 2)
+	require.Equal(t, "token secret", (*records)[0].Header.Get("Authorization"))
+	require.Equal(t, true, (*records)[1].Body["merge_when_checks_succeed"])
+}
+
+func TestCoding(t *testing.T) {
+	s, records := newForgeServerForTest(t, map[string]string{
+		"POST /open-api?Action=CreateGitMergeRequest": `{"Response": {"MergeInfo": {"MergeId": 9}}}`,
+		"POST /open-api?Action=MergeGitMergeRequest":  `{"Response": {"Error": {"Code": "Conflict", "Message": "cannot merge"}}}`,
+	})
+
+	f, err := New(Options{Kind: KindCoding, APIURL: s.URL + "/open-api", Repo: "team/project/repo", Username: "user", Token: "secret"})
+	require.NoError(t, err)
+
+	mr, err := f.CreateMergeRequest(context.Background(), testMergeRequest)
+	require.NoError(t, err)
+	require.Equal(t, s.URL+"/p/project/d/repo/git/merge/9", mr.URL)
+
+	err = f.EnableAutoMerge(context.Background(), mr)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot merge")
+
+	require.Len(t, *records, 2)
+	require.Equal(t, "team/project/repo", (*records)[0].Body["DepotPath"])
+	require.Equal(t, "fastci/app-1", (*records)[0].Body["SrcBranch"])
+	require.Equal(t, float64(9), (*records)[1].Body["MergeId"])
+}
+
+func TestCodingWebURL(t *testing.T) {
+	c := &coding{client{apiURL: "https://e.coding.net/open-api", repo: "team/project/repo"}}
+	require.Equal(t, "https://team.coding.net/p/project/d/repo/git/merge/9", c.webURL(9))
+
+	c.apiURL = "https://coding.example.com/open-api"
+	require.Equal(t, "https://coding.example.com/p/project/d/repo/git/merge/9", c.webURL(9))
+}
+
+func TestDetectKind(t *testing.T) {
+	require.Equal(t, KindGitHub, DetectKind("github.com"))
+	require.Equal(t, KindGitLab, DetectKind("gitlab.example.com"))
+	require.Equal(t, KindGitea, DetectKind("codeberg.org"))
+	require.Equal(t, KindCoding, DetectKind("e.coding.net"))
+	require.Equal(t, "", DetectKind("git.example.com"))
+
+	require.Equal(t, "https://api.github.com", DefaultAPIURL(KindGitHub, "github.com"))
+	require.Equal(t, "https://gitlab.example.com/api/v4", DefaultAPIURL(KindGitLab, "gitlab.example.com"))
+}
+
+func TestNewUnsupported(t *testing.T) {
+	_, err := New(Options{Kind: "svn", APIURL: "http://localhost", Repo: "a/b"})
+	require.Error(t, err)
+}
@@ -0,0 +1,40 @@
+package fastforge
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+type gitea struct {
+	client
+}
+
+func (g *gitea) auth(req *http.Request) {
+	req.Header.Set("Authorization", "token "+g.token)
+}
+
+func (g *gitea) CreateMergeRequest(ctx context.Context, req MergeRequest) (mr MergeRequestResult, err error) {
+	var res struct {
+		Number  int64  `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err = g.do(ctx, http.MethodPost, g.apiURL+"/repos/"+g.repo+"/pulls", g.auth, map[string]any{
+		"title": req.Title,
+		"head":  req.SourceBranch,
+		"base":  req.TargetBranch,
+		"body":  req.Description,
+	}, &res); err != nil {
+		return
+	}
+	mr = MergeRequestResult{Number: res.Number, URL: res.HTMLURL}
+	return
+}
+
+func (g *gitea) EnableAutoMerge(ctx context.Context, mr MergeRequestResult) (err error) {
+	return g.do(ctx, http.MethodPost, g.apiURL+"/repos/"+g.repo+"/pulls/"+strconv.FormatInt(mr.Number, 10)+"/merge", g.auth, map[string]any{
+		"Do":                        "merge",
+		"merge_when_checks_succeed": true,
+		"delete_branch_after_merge": true,
+	}, nil)
+}
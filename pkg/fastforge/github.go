@@ -0,0 +1,63 @@
+package fastforge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type github struct {
+	client
+}
+
+func (g *github) auth(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+}
+
+func (g *github) CreateMergeRequest(ctx context.Context, req MergeRequest) (mr MergeRequestResult, err error) {
+	var res struct {
+		Number  int64  `json:"number"`
+		NodeID  string `json:"node_id"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err = g.do(ctx, http.MethodPost, g.apiURL+"/repos/"+g.repo+"/pulls", g.auth, map[string]any{
+		"title": req.Title,
+		"head":  req.SourceBranch,
+		"base":  req.TargetBranch,
+		"body":  req.Description,
+	}, &res); err != nil {
+		return
+	}
+	mr = MergeRequestResult{Number: res.Number, NodeID: res.NodeID, URL: res.HTMLURL}
+	return
+}
+
+// graphqlURL returns the GraphQL endpoint
+func (g *github) graphqlURL() string {
+	if base, ok := strings.CutSuffix(g.apiURL, "/v3"); ok {
+		return base + "/graphql"
+	}
+	return g.apiURL + "/graphql"
+}
+
+func (g *github) EnableAutoMerge(ctx context.Context, mr MergeRequestResult) (err error) {
+	var res struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err = g.do(ctx, http.MethodPost, g.graphqlURL(), g.auth, map[string]any{
+		"query": `mutation($id: ID!) { enablePullRequestAutoMerge(input: {pullRequestId: $id}) { clientMutationId } }`,
+		"variables": map[string]any{
+			"id": mr.NodeID,
+		},
+	}, &res); err != nil {
+		return
+	}
+	if len(res.Errors) > 0 {
+		err = errors.New("github graphql error: " + res.Errors[0].Message)
+	}
+	return
+}
@@ -0,0 +1,73 @@
+package fastforge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	gitlabMergeAttempts = 5
+)
+
+var (
+	// GitLabMergeRetryInterval is the interval of enabling auto merge
+	GitLabMergeRetryInterval = 2 * time.Second
+)
+
+type gitlab struct {
+	client
+}
+
+func (g *gitlab) auth(req *http.Request) {
+	req.Header.Set("PRIVATE-TOKEN", g.token)
+}
+
+func (g *gitlab) projectURL() string {
+	return g.apiURL + "/projects/" + url.PathEscape(g.repo)
+}
+
+func (g *gitlab) CreateMergeRequest(ctx context.Context, req MergeRequest) (mr MergeRequestResult, err error) {
+	var res struct {
+		IID    int64  `json:"iid"`
+		WebURL string `json:"web_url"`
+	}
+	if err = g.do(ctx, http.MethodPost, g.projectURL()+"/merge_requests", g.auth, map[string]any{
+		"source_branch":        req.SourceBranch,
+		"target_branch":        req.TargetBranch,
+		"title":                req.Title,
+		"description":          req.Description,
+		"remove_source_branch": true,
+	}, &res); err != nil {
+		return
+	}
+	mr = MergeRequestResult{Number: res.IID, URL: res.WebURL}
+	return
+}
+
+func (g *gitlab) EnableAutoMerge(ctx context.Context, mr MergeRequestResult) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = g.do(ctx, http.MethodPut, g.projectURL()+"/merge_requests/"+strconv.FormatInt(mr.Number, 10)+"/merge", g.auth, map[string]any{
+			"auto_merge":                   true,
+			"merge_when_pipeline_succeeds": true,
+			"should_remove_source_branch":  true,
+		}, nil); err == nil {
+			return
+		}
+
+		// 405 and 406 are returned while the merge request is still being checked
+		var se *StatusError
+		if !errors.As(err, &se) || (se.Code != http.StatusMethodNotAllowed && se.Code != http.StatusNotAcceptable) || attempt >= gitlabMergeAttempts {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(GitLabMergeRetryInterval):
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package fastjs
 
 import (
+	"time"
+
 	"github.com/robertkrimen/otto"
 )
 
@@ -29,3 +31,16 @@ func Array[T any](rp RuntimeProvider, arr []T) (obj *otto.Object, err error) {
 	}
 	return
 }
+
+// ToDuration converts seconds or a string like "10m" to duration.
+func ToDuration(val otto.Value) (d time.Duration, err error) {
+	if val.IsNumber() {
+		var seconds float64
+		if seconds, err = val.ToFloat(); err != nil {
+			return
+		}
+		d = time.Duration(seconds * float64(time.Second))
+		return
+	}
+	return time.ParseDuration(val.String())
+}
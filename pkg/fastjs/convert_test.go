@@ -2,9 +2,11 @@ package fastjs
 
 import (
 	"testing"
+	"time"
 
 	"github.com/robertkrimen/otto"
 	"github.com/stretchr/testify/require"
+	"github.com/yankeguo/rg"
 )
 
 func TestObject(t *testing.T) {
@@ -30,3 +32,16 @@ func TestArray(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int64(1), valInt64)
 }
+
+func TestToDuration(t *testing.T) {
+	_, err := ToDuration(otto.UndefinedValue())
+	require.Error(t, err)
+
+	d, err := ToDuration(rg.Must(otto.ToValue(1.5)))
+	require.NoError(t, err)
+	require.Equal(t, 1500*time.Millisecond, d)
+
+	d, err = ToDuration(rg.Must(otto.ToValue("10m")))
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Minute, d)
+}
@@ -1,7 +1,9 @@
 package fastjs
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/robertkrimen/otto"
 )
@@ -59,3 +61,79 @@ func LoadFunctionField(out *otto.Value, obj *otto.Object, name string) (err erro
 	*out = val
 	return
 }
+
+func LoadDurationField(out *time.Duration, obj *otto.Object, name string) (err error) {
+	var val otto.Value
+	if val, err = obj.Get(name); err != nil {
+		return
+	}
+	if val.IsUndefined() {
+		return
+	}
+	if val.IsNull() {
+		*out = 0
+		return
+	}
+	if *out, err = ToDuration(val); err != nil {
+		err = fmt.Errorf("field %s should be a duration: %w", name, err)
+		return
+	}
+	return
+}
+
+func LoadIntField(out *int, obj *otto.Object, name string) (err error) {
+	var val otto.Value
+	if val, err = obj.Get(name); err != nil {
+		return
+	}
+	if val.IsUndefined() {
+		return
+	}
+	if val.IsNull() {
+		*out = 0
+		return
+	}
+	if !val.IsNumber() {
+		err = fmt.Errorf("field %s should be a number", name)
+		return
+	}
+	var n int64
+	if n, err = val.ToInteger(); err != nil {
+		return
+	}
+	*out = int(n)
+	return
+}
+
+func LoadStringSliceField(out *[]string, obj *otto.Object, name string) (err error) {
+	var val otto.Value
+	if val, err = obj.Get(name); err != nil {
+		return
+	}
+	if val.IsUndefined() {
+		return
+	}
+	if val.IsNull() {
+		*out = nil
+		return
+	}
+	if val.IsString() {
+		*out = []string{val.String()}
+		return
+	}
+	if !val.IsObject() || val.Class() != "Array" {
+		err = fmt.Errorf("field %s should be a string or an array of strings", name)
+		return
+	}
+	var buf []byte
+	if buf, err = val.Object().MarshalJSON(); err != nil {
+		return
+	}
+	var values []string
+	if err = json.Unmarshal(buf, &values); err != nil {
+		err = fmt.Errorf("field %s should be a string or an array of strings: %w", name, err)
+		return
+	}
+	*out = values
+	return
+}
@@ -2,6 +2,7 @@ package fastjs
 
 import (
 	"testing"
+	"time"
 
 	"github.com/robertkrimen/otto"
 	"github.com/stretchr/testify/require"
@@ -81,3 +82,85 @@ func TestLoadFunctionField(t *testing.T) {
 	LoadFunctionField(&out, obj, "a")
 	require.True(t, out.IsFunction())
 }
+
+func TestLoadDurationField(t *testing.T) {
+	var out time.Duration
+	vm := otto.New()
+
+	obj, err := vm.Object("({a:'5m'})")
+	require.NoError(t, err)
+	require.NoError(t, LoadDurationField(&out, obj, "a"))
+	require.Equal(t, 5*time.Minute, out)
+
+	obj, err = vm.Object("({})")
+	require.NoError(t, err)
+	require.NoError(t, LoadDurationField(&out, obj, "a"))
+	require.Equal(t, 5*time.Minute, out)
+
+	obj, err = vm.Object("({a:1.5})")
+	require.NoError(t, err)
+	require.NoError(t, LoadDurationField(&out, obj, "a"))
+	require.Equal(t, 1500*time.Millisecond, out)
+
+	obj, err = vm.Object("({a:null})")
+	require.NoError(t, err)
+	require.NoError(t, LoadDurationField(&out, obj, "a"))
+	require.Equal(t, time.Duration(0), out)
+
+	obj, err = vm.Object("({a:'forever'})")
+	require.NoError(t, err)
+	require.Error(t, LoadDurationField(&out, obj, "a"))
+}
+
+func TestLoadIntField(t *testing.T) {
+	var out int
+	vm := otto.New()
+
+	obj, err := vm.Object("({a:3})")
+	require.NoError(t, err)
+	require.NoError(t, LoadIntField(&out, obj, "a"))
+	require.Equal(t, 3, out)
+
+	obj, err = vm.Object("({})")
+	require.NoError(t, err)
+	require.NoError(t, LoadIntField(&out, obj, "a"))
+	require.Equal(t, 3, out)
+
+	obj, err = vm.Object("({a:null})")
+	require.NoError(t, err)
+	require.NoError(t, LoadIntField(&out, obj, "a"))
+	require.Equal(t, 0, out)
+
+	obj, err = vm.Object("({a:'3'})")
+	require.NoError(t, err)
+	require.Error(t, LoadIntField(&out, obj, "a"))
+}
+
+func TestLoadStringSliceField(t *testing.T) {
+	var out []string
+	vm := otto.New()
+
+	obj, err := vm.Object("({a:['bash','-eu']})")
+	require.NoError(t, err)
+	require.NoError(t, LoadStringSliceField(&out, obj, "a"))
+	require.Equal(t, []string{"bash", "-eu"}, out)
+
+	obj, err = vm.Object("({})")
+	require.NoError(t, err)
+	require.NoError(t, LoadStringSliceField(&out, obj, "a"))
+	require.Equal(t, []string{"bash", "-eu"}, out)
+
+	obj, err = vm.Object("({a:'sh'})")
+	require.NoError(t, err)
+	require.NoError(t, LoadStringSliceField(&out, obj, "a"))
+	require.Equal(t, []string{"sh"}, out)
+
+	obj, err = vm.Object("({a:null})")
+	require.NoError(t, err)
+	require.NoError(t, LoadStringSliceField(&out, obj, "a"))
+	require.Nil(t, out)
+
+	obj, err = vm.Object("({a:1})")
+	require.NoError(t, err)
+	require.Error(t, LoadStringSliceField(&out, obj, "a"))
+}
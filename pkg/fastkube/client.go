@@ -0,0 +1,310 @@
+package fastkube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ContentTypeJSON is the content type for plain JSON requests
+	ContentTypeJSON = "application/json"
+	// ContentTypeStrategicMergePatch is the content type for strategic merge patch requests
+	ContentTypeStrategicMergePatch = "application/strategic-merge-patch+json"
+)
+
+// Kubeconfig is the subset of kubeconfig file used by fastkube
+type Kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+			TLSServerName            string `yaml:"tls-server-name"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Username              string `yaml:"username"`
+			Password              string `yaml:"password"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// StatusError is returned when the Kubernetes API server responds with a non-2xx status code
+type StatusError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("kubernetes api error: %d %s: %s", e.Code, e.Reason, e.Message)
+	}
+	return fmt.Sprintf("kubernetes api error: %d %s", e.Code, e.Reason)
+}
+
+// IsNotFound returns true if the error is a StatusError with code 404
+func IsNotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+// Client is a minimal Kubernetes REST API client
+type Client struct {
+	server    string
+	namespace string
+	token     string
+	username  string
+	password  string
+	hc        *http.Client
+}
+
+func resolveFile(dir string, file string) string {
+	if file == "" || filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+func loadData(data string, file string) (buf []byte, err error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	return
+}
+
+// NewClient creates a new Client from the current context of the kubeconfig file
+func NewClient(kubeconfigPath string) (c *Client, err error) {
+	var buf []byte
+	if buf, err = os.ReadFile(kubeconfigPath); err != nil {
+		return
+	}
+
+	var kc Kubeconfig
+	if err = yaml.Unmarshal(buf, &kc); err != nil {
+		return
+	}
+
+	return NewClientFromKubeconfig(kc, filepath.Dir(kubeconfigPath))
+}
+
+// NewClientFromKubeconfig creates a Client of the current context, relative certificate and key paths are resolved against dir
+func NewClientFromKubeconfig(kc Kubeconfig, dir string) (c *Client, err error) {
+	contextName := kc.CurrentContext
+	if contextName == "" && len(kc.Contexts) == 1 {
+		contextName = kc.Contexts[0].Name
+	}
+
+	var clusterName, userName string
+
+	c = &Client{}
+
+	for _, item := range kc.Contexts {
+		if item.Name == contextName {
+			clusterName = item.Context.Cluster
+			userName = item.Context.User
+			c.namespace = item.Context.Namespace
+		}
+	}
+
+	if clusterName == "" && len(kc.Clusters) == 1 {
+		clusterName = kc.Clusters[0].Name
+	}
+	if userName == "" && len(kc.Users) == 1 {
+		userName = kc.Users[0].Name
+	}
+
+	tlsConfig := &tls.Config{}
+
+	var foundCluster bool
+
+	for _, item := range kc.Clusters {
+		if item.Name != clusterName {
+			continue
+		}
+		foundCluster = true
+
+		c.server = strings.TrimSuffix(item.Cluster.Server, "/")
+
+		tlsConfig.InsecureSkipVerify = item.Cluster.InsecureSkipTLSVerify
+		tlsConfig.ServerName = item.Cluster.TLSServerName
+
+		var bufCA []byte
+		if bufCA, err = loadData(item.Cluster.CertificateAuthorityData, resolveFile(dir, item.Cluster.CertificateAuthority)); err != nil {
+			return
+		}
+		if len(bufCA) > 0 {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(bufCA) {
+				err = errors.New("invalid certificate authority in kubeconfig")
+				return
+			}
+		}
+	}
+
+	if !foundCluster || c.server == "" {
+		err = fmt.Errorf("cluster not found in kubeconfig: %q", clusterName)
+		return
+	}
+
+	for _, item := range kc.Users {
+		if item.Name != userName {
+			continue
+		}
+
+		c.token = item.User.Token
+		if c.token == "" && item.User.TokenFile != "" {
+			var buf []byte
+			if buf, err = os.ReadFile(resolveFile(dir, item.User.TokenFile)); err != nil {
+				return
+			}
+			c.token = strings.TrimSpace(string(buf))
+		}
+		c.username = item.User.Username
+		c.password = item.User.Password
+
+		var bufCert, bufKey []byte
+		if bufCert, err = loadData(item.User.ClientCertificateData, resolveFile(dir, item.User.ClientCertificate)); err != nil {
+			return
+		}
+		if bufKey, err = loadData(item.User.ClientKeyData, resolveFile(dir, item.User.ClientKey)); err != nil {
+			return
+		}
+		if len(bufCert) > 0 && len(bufKey) > 0 {
+			var cert tls.Certificate
+			if cert, err = tls.X509KeyPair(bufCert, bufKey); err != nil {
+				return
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	if c.namespace == "" {
+		c.namespace = "default"
+	}
+
+	c.hc = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	return
+}
+
+// Namespace returns the namespace of the current context, or "default"
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// Do performs a request with JSON body and response,
+// a []byte body is sent as is, and a *[]byte out receives the raw response
+func (c *Client) Do(ctx context.Context, method string, path string, query url.Values, contentType string, body any, out any) (err error) {
+	u := c.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		if buf, ok := body.([]byte); ok {
+			reqBody = bytes.NewReader(buf)
+		} else {
+			var buf []byte
+			if buf, err = json.Marshal(body); err != nil {
+				return
+			}
+			reqBody = bytes.NewReader(buf)
+		}
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, method, u, reqBody); err != nil {
+		return
+	}
+	req.Header.Set("Accept", ContentTypeJSON)
+	if body != nil {
+		if contentType == "" {
+			contentType = ContentTypeJSON
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	var res *http.Response
+	if res, err = c.hc.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	var buf []byte
+	if buf, err = io.ReadAll(res.Body); err != nil {
+		return
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		se := &StatusError{Code: res.StatusCode, Reason: http.StatusText(res.StatusCode)}
+		var status struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(buf, &status) == nil {
+			if status.Reason != "" {
+				se.Reason = status.Reason
+			}
+			se.Message = status.Message
+		}
+		err = se
+		return
+	}
+
+	if out == nil {
+		return
+	}
+	if outBuf, ok := out.(*[]byte); ok {
+		*outBuf = buf
+		return
+	}
+	err = json.Unmarshal(buf, out)
+	return
+}
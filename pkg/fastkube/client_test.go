@@ -0,0 +1,79 @@
+package fastkube
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClient(t *testing.T) {
+	var gotAuth string
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		if r.URL.Path == "/api/v1/namespaces/demo" {
+			w.Header().Set("Content-Type", ContentTypeJSON)
+			w.Write([]byte(`{"metadata":{"name":"demo"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind":"Status","reason":"NotFound","message":"not found"}`))
+	}))
+	defer srv.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("hello\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "kubeconfig"), []byte(`
+apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+  - name: test
+    cluster:
+      server: `+srv.URL+`
+      certificate-authority-data: `+base64.StdEncoding.EncodeToString(ca)+`
+contexts:
+  - name: test
+    context:
+      cluster: test
+      user: test
+      namespace: demo
+users:
+  - name: test
+    user:
+      tokenFile: token
+`), 0600))
+
+	c, err := NewClient(filepath.Join(dir, "kubeconfig"))
+	require.NoError(t, err)
+	require.Equal(t, "demo", c.Namespace())
+
+	var obj struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	err = c.Do(context.Background(), http.MethodGet, "/api/v1/namespaces/demo", nil, "", nil, &obj)
+	require.NoError(t, err)
+	require.Equal(t, "demo", obj.Metadata.Name)
+	require.Equal(t, "Bearer hello", gotAuth)
+
+	err = c.Do(context.Background(), http.MethodGet, "/api/v1/namespaces/missing", nil, "", nil, nil)
+	require.Error(t, err)
+	require.True(t, IsNotFound(err))
+	require.Contains(t, err.Error(), "not found")
+}
+
+func TestNewClientMissingCluster(t *testing.T) {
+	_, err := NewClientFromKubeconfig(Kubeconfig{CurrentContext: "missing"}, "")
+	require.Error(t, err)
+}
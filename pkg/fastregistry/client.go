@@ -0,0 +1,500 @@
+package fastregistry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// MediaTypeDockerManifest is the media type of docker image manifest
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	// MediaTypeDockerManifestList is the media type of docker manifest list
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// MediaTypeOCIManifest is the media type of OCI image manifest
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	// MediaTypeOCIIndex is the media type of OCI image index, for multiple platforms
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+)
+
+var (
+	// manifestMediaTypes are accepted media types of manifests
+	manifestMediaTypes = []string{
+		MediaTypeOCIIndex,
+		MediaTypeOCIManifest,
+		MediaTypeDockerManifestList,
+		MediaTypeDockerManifest,
+	}
+
+	// challengeParam matches parameters of WWW-Authenticate
+	challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// StatusError is returned when the registry responds with an unexpected status code
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("registry api error: %d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+	}
+	return fmt.Sprintf("registry api error: %d %s", e.Code, http.StatusText(e.Code))
+}
+
+// IsNotFound returns true if the error is a StatusError with code 404
+func IsNotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+// checkResponse returns a StatusError for unexpected status
+func checkResponse(res *http.Response, codes ...int) error {
+	if slices.Contains(codes, res.StatusCode) {
+		return nil
+	}
+	se := &StatusError{Code: res.StatusCode}
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if buf, err := io.ReadAll(io.LimitReader(res.Body, 64*1024)); err == nil && json.Unmarshal(buf, &body) == nil {
+		var messages []string
+		for _, item := range body.Errors {
+			messages = append(messages, strings.TrimSpace(item.Code+" "+item.Message))
+		}
+		se.Message = strings.Join(messages, ", ")
+	}
+	return se
+}
+
+// Platform is the platform of an image in manifest list
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Descriptor describes a blob or a manifest
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	URLs      []string  `json:"urls,omitempty"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Manifest is a raw manifest, copied as is to keep the digest
+type Manifest struct {
+	MediaType string
+	Digest    string
+	Body      []byte
+
+	Config    Descriptor
+	Layers    []Descriptor
+	Manifests []Descriptor
+}
+
+// IsIndex checks if the manifest is a manifest list or an image index
+func (m *Manifest) IsIndex() bool {
+	return m.MediaType == MediaTypeDockerManifestList || m.MediaType == MediaTypeOCIIndex
+}
+
+// parseManifest parses a manifest, preferring its media type
+func parseManifest(contentType string, body []byte) (m *Manifest, err error) {
+	var content struct {
+		MediaType string       `json:"mediaType"`
+		Config    Descriptor   `json:"config"`
+		Layers    []Descriptor `json:"layers"`
+		Manifests []Descriptor `json:"manifests"`
+	}
+	if err = json.Unmarshal(body, &content); err != nil {
+		err = fmt.Errorf("invalid manifest: %w", err)
+		return
+	}
+	sum := sha256.Sum256(body)
+	m = &Manifest{
+		MediaType: content.MediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Body:      body,
+		Config:    content.Config,
+		Layers:    content.Layers,
+		Manifests: content.Manifests,
+	}
+	if m.MediaType == "" {
+		m.MediaType, _, _ = strings.Cut(contentType, ";")
+	}
+	if !slices.Contains(manifestMediaTypes, m.MediaType) {
+		err = fmt.Errorf("unsupported manifest media type %q", m.MediaType)
+	}
+	return
+}
+
+// Options are options of NewClient
+type Options struct {
+	// Config provides credentials of registries
+	Config DockerConfig
+	// PlainHTTP are registries without TLS, besides loopback
+	PlainHTTP []string
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// Client is a minimal client of Docker Registry HTTP API v2
+type Client struct {
+	opts Options
+	hc   *http.Client
+
+	mu sync.Mutex
+	// tokens are bearer tokens, by registry and scope
+	tokens map[string]string
+	// basic are registries using basic authentication
+	basic map[string]bool
+}
+
+// NewClient creates a new Client
+func NewClient(opts Options) *Client {
+	hc := opts.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{
+		opts:   opts,
+		hc:     hc,
+		tokens: map[string]string{},
+		basic:  map[string]bool{},
+	}
+}
+
+// baseURL returns the url of registry API, like "https://registry.example.com"
+func (c *Client) baseURL(registry string) string {
+	host := registry
+	if host == DefaultRegistry {
+		host = dockerHubHost
+	}
+	scheme := "https"
+	if slices.Contains(c.opts.PlainHTTP, registry) || isLoopback(host) {
+		scheme = "http"
+	}
+	return scheme + "://" + host
+}
+
+func isLoopback(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// pullScope and pushScope are scopes of bearer tokens
+func pullScope(ref Reference) string {
+	return "repository:" + ref.Repository + ":pull"
+}
+
+func pushScope(ref Reference) string {
+	return "repository:" + ref.Repository + ":pull,push"
+}
+
+func (c *Client) authorize(req *http.Request, registry string, scope string) {
+	c.mu.Lock()
+	token, basic := c.tokens[registry+" "+scope], c.basic[registry]
+	c.mu.Unlock()
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if basic {
+		cred := c.opts.Config.Credential(registry)
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+}
+
+// authenticate answers a basic or bearer challenge
+func (c *Client) authenticate(ctx context.Context, registry string, scope string, challenge string) (err error) {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	params := map[string]string{}
+	for _, match := range challengeParam.FindAllStringSubmatch(rest, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	cred := c.opts.Config.Credential(registry)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if cred.Username == "" {
+			return fmt.Errorf("no credentials for registry %s", registry)
+		}
+		c.mu.Lock()
+		c.basic[registry] = true
+		c.mu.Unlock()
+		return
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported authentication scheme %q of registry %s", scheme, registry)
+	}
+
+	if params["realm"] == "" {
+		return fmt.Errorf("missing realm in authentication challenge of registry %s", registry)
+	}
+
+	var u *url.URL
+	if u, err = url.Parse(params["realm"]); err != nil {
+		return
+	}
+	query := u.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	for _, item := range strings.Fields(scope) {
+		query.Add("scope", item)
+	}
+	u.RawQuery = query.Encode()
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil); err != nil {
+		return
+	}
+	if cred.Username != "" {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+
+	var res *http.Response
+	if res, err = c.hc.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if err = checkResponse(res, http.StatusOK); err != nil {
+		return fmt.Errorf("failed to get token of registry %s: %w", registry, err)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return fmt.Errorf("empty token of registry %s", registry)
+	}
+
+	c.mu.Lock()
+	c.tokens[registry+" "+scope] = token
+	c.mu.Unlock()
+	return
+}
+
+// do performs a request, retried after authentication
+func (c *Client) do(ctx context.Context, registry string, scope string, newRequest func() (*http.Request, error)) (res *http.Response, err error) {
+	var req *http.Request
+	if req, err = newRequest(); err != nil {
+		return
+	}
+	c.authorize(req, registry, scope)
+	if res, err = c.hc.Do(req.WithContext(ctx)); err != nil {
+		return
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return
+	}
+
+	challenge := res.Header.Get("WWW-Authenticate")
+	res.Body.Close()
+	if err = c.authenticate(ctx, registry, scope, challenge); err != nil {
+		return
+	}
+
+	if req, err = newRequest(); err != nil {
+		return
+	}
+	c.authorize(req, registry, scope)
+	return c.hc.Do(req.WithContext(ctx))
+}
+
+// GetManifest gets the manifest of reference, by tag or digest
+func (c *Client) GetManifest(ctx context.Context, ref Reference) (m *Manifest, err error) {
+	u := c.baseURL(ref.Registry) + "/v2/" + ref.Repository + "/manifests/" + ref.identifier()
+
+	var res *http.Response
+	if res, err = c.do(ctx, ref.Registry, pullScope(ref), func() (req *http.Request, err error) {
+		if req, err = http.NewRequest(http.MethodGet, u, nil); err != nil {
+			return
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		return
+	}); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if err = checkResponse(res, http.StatusOK); err != nil {
+		return
+	}
+
+	var buf []byte
+	if buf, err = io.ReadAll(res.Body); err != nil {
+		return
+	}
+	if m, err = parseManifest(res.Header.Get("Content-Type"), buf); err != nil {
+		return
+	}
+	if ref.Digest != "" && ref.Digest != m.Digest {
+		err = fmt.Errorf("digest mismatch of manifest %s, got %s", ref.String(), m.Digest)
+	}
+	return
+}
+
+// PutManifest puts the manifest to reference, by tag or digest
+func (c *Client) PutManifest(ctx context.Context, ref Reference, m *Manifest) (err error) {
+	u := c.baseURL(ref.Registry) + "/v2/" + ref.Repository + "/manifests/" + ref.identifier()
+
+	var res *http.Response
+	if res, err = c.do(ctx, ref.Registry, pushScope(ref), func() (req *http.Request, err error) {
+		if req, err = http.NewRequest(http.MethodPut, u, bytes.NewReader(m.Body)); err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", m.MediaType)
+		return
+	}); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	return checkResponse(res, http.StatusCreated, http.StatusOK)
+}
+
+// GetBlob gets the content of blob, the caller should close the reader
+func (c *Client) GetBlob(ctx context.Context, ref Reference, digest string) (body io.ReadCloser, size int64, err error) {
+	u := c.baseURL(ref.Registry) + "/v2/" + ref.Repository + "/blobs/" + digest
+
+	var res *http.Response
+	if res, err = c.do(ctx, ref.Registry, pullScope(ref), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, u, nil)
+	}); err != nil {
+		return
+	}
+	if err = checkResponse(res, http.StatusOK); err != nil {
+		res.Body.Close()
+		return
+	}
+	return res.Body, res.ContentLength, nil
+}
+
+// HasBlob checks if the blob exists in the repository
+func (c *Client) HasBlob(ctx context.Context, ref Reference, digest string) (exists bool, err error) {
+	u := c.baseURL(ref.Registry) + "/v2/" + ref.Repository + "/blobs/" + digest
+
+	var res *http.Response
+	if res, err = c.do(ctx, ref.Registry, pushScope(ref), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, u, nil)
+	}); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return
+	}
+	if err = checkResponse(res, http.StatusOK); err != nil {
+		return
+	}
+	exists = true
+	return
+}
+
+// CopyBlob copies a blob, mounted within the same registry
+func (c *Client) CopyBlob(ctx context.Context, src Reference, dst Reference, desc Descriptor) (err error) {
+	var exists bool
+	if exists, err = c.HasBlob(ctx, dst, desc.Digest); err != nil || exists {
+		return
+	}
+
+	base := c.baseURL(dst.Registry)
+
+	u := base + "/v2/" + dst.Repository + "/blobs/uploads/"
+	scope := pushScope(dst)
+	if src.Registry == dst.Registry {
+		u += "?" + url.Values{"mount": {desc.Digest}, "from": {src.Repository}}.Encode()
+		scope += " " + pullScope(src)
+	}
+
+	var res *http.Response
+	if res, err = c.do(ctx, dst.Registry, scope, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, u, nil)
+	}); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	// mounted
+	if res.StatusCode == http.StatusCreated {
+		return
+	}
+	if err = checkResponse(res, http.StatusAccepted); err != nil {
+		return
+	}
+
+	// upload location, may be relative
+	var location *url.URL
+	if location, err = url.Parse(res.Header.Get("Location")); err != nil {
+		return
+	}
+	var baseURL *url.URL
+	if baseURL, err = url.Parse(base); err != nil {
+		return
+	}
+	location = baseURL.ResolveReference(location)
+	query := location.Query()
+	query.Set("digest", desc.Digest)
+	location.RawQuery = query.Encode()
+
+	if res, err = c.do(ctx, dst.Registry, scope, func() (req *http.Request, err error) {
+		var body io.ReadCloser
+		if body, _, err = c.GetBlob(ctx, src, desc.Digest); err != nil {
+			return
+		}
+		if req, err = http.NewRequest(http.MethodPut, location.String(), body); err != nil {
+			body.Close()
+			return
+		}
+		req.ContentLength = desc.Size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return
+	}); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	return checkResponse(res, http.StatusCreated)
+}
@@ -0,0 +1,263 @@
+package fastregistry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistry is an in-memory registry, for "user" and "pass"
+type fakeRegistry struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string][2]string
+	blobs     map[string][]byte
+	mounts    int
+	uploads   int
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	f := &fakeRegistry{
+		t:         t,
+		manifests: map[string][2]string{},
+		blobs:     map[string][]byte{},
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeRegistry) host() string {
+	return strings.TrimPrefix(f.srv.URL, "http://")
+}
+
+func fakeDigest(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (f *fakeRegistry) putBlob(repo string, content string) Descriptor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	digest := fakeDigest([]byte(content))
+	f.blobs[repo+" "+digest] = []byte(content)
+	return Descriptor{MediaType: "application/octet-stream", Digest: digest, Size: int64(len(content))}
+}
+
+func (f *fakeRegistry) putManifest(repo string, tag string, mediaType string, content any) Descriptor {
+	buf, err := json.Marshal(content)
+	require.NoError(f.t, err)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	digest := fakeDigest(buf)
+	f.manifests[repo+" "+tag] = [2]string{mediaType, string(buf)}
+	f.manifests[repo+" "+digest] = [2]string{mediaType, string(buf)}
+	return Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(buf))}
+}
+
+// putImage puts a single platform image with a config and a layer
+func (f *fakeRegistry) putImage(repo string, tag string, arch string) Descriptor {
+	config := f.putBlob(repo, `{"created":"2024-01-02T03:04:05Z","architecture":"`+arch+`","os":"linux","config":{"Labels":{"team":"infra"}}}`)
+	layer := f.putBlob(repo, "layer of "+arch)
+	return f.putManifest(repo, tag, MediaTypeOCIManifest, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     MediaTypeOCIManifest,
+		"config":        config,
+		"layers":        []Descriptor{layer},
+	})
+}
+
+func (f *fakeRegistry) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		if username, password, _ := r.BasicAuth(); username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "t0ken"})
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer t0ken" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+f.srv.URL+`/token",service="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`))
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+
+	if repo, ref, ok := strings.Cut(p, "/manifests/"); ok {
+		switch r.Method {
+		case http.MethodGet:
+			m, ok := f.manifests[repo+" "+ref]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+				return
+			}
+			w.Header().Set("Content-Type", m[0])
+			w.Write([]byte(m[1]))
+		case http.MethodPut:
+			buf, _ := io.ReadAll(r.Body)
+			m := [2]string{r.Header.Get("Content-Type"), string(buf)}
+			f.manifests[repo+" "+ref] = m
+			f.manifests[repo+" "+fakeDigest(buf)] = m
+			w.WriteHeader(http.StatusCreated)
+		}
+		return
+	}
+
+	if repo, rest, ok := strings.Cut(p, "/blobs/uploads/"); ok {
+		switch r.Method {
+		case http.MethodPost:
+			if digest, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from"); digest != "" {
+				if buf, ok := f.blobs[from+" "+digest]; ok {
+					f.blobs[repo+" "+digest] = buf
+					f.mounts++
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+			}
+			w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+strconv.Itoa(f.uploads)+"?state=fake")
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			require.Equal(f.t, "fake", r.URL.Query().Get("state"), rest)
+			buf, _ := io.ReadAll(r.Body)
+			digest := r.URL.Query().Get("digest")
+			if fakeDigest(buf) != digest {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			f.blobs[repo+" "+digest] = buf
+			f.uploads++
+			w.WriteHeader(http.StatusCreated)
+		}
+		return
+	}
+
+	if repo, digest, ok := strings.Cut(p, "/blobs/"); ok {
+		buf, ok := f.blobs[repo+" "+digest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+		if r.Method == http.MethodGet {
+			w.Write(buf)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (f *fakeRegistry) client() *Client {
+	return NewClient(Options{Config: DockerConfig{Auths: map[string]DockerConfigAuth{
+		f.host(): {Username: "user", Password: "pass"},
+	}}})
+}
+
+func (f *fakeRegistry) ref(s string) Reference {
+	ref, err := ParseReference(f.host() + "/" + s)
+	require.NoError(f.t, err)
+	return ref
+}
+
+func TestClientCopyIndex(t *testing.T) {
+	src := newFakeRegistry(t)
+	amd64 := src.putImage("team/app", "amd64", "amd64")
+	arm64 := src.putImage("team/app", "arm64", "arm64")
+	amd64.Platform = &Platform{OS: "linux", Architecture: "amd64"}
+	arm64.Platform = &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	index := src.putManifest("team/app", "1.0", MediaTypeOCIIndex, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     MediaTypeOCIIndex,
+		"manifests":     []Descriptor{amd64, arm64},
+	})
+
+	dst := newFakeRegistry(t)
+
+	// credentials of both registries
+	c := NewClient(Options{Config: DockerConfig{Auths: map[string]DockerConfigAuth{
+		src.host(): {Username: "user", Password: "pass"},
+		dst.host(): {Username: "user", Password: "pass"},
+	}}})
+
+	m, err := c.Copy(context.Background(), src.ref("team/app:1.0"), dst.ref("prod/app:1.0"))
+	require.NoError(t, err)
+	require.Equal(t, index.Digest, m.Digest)
+	require.Equal(t, 4, dst.uploads)
+	require.Zero(t, dst.mounts)
+
+	// digests are kept
+	got, err := c.GetManifest(context.Background(), dst.ref("prod/app:1.0"))
+	require.NoError(t, err)
+	require.Equal(t, index.Digest, got.Digest)
+	_, err = c.GetManifest(context.Background(), dst.ref("prod/app@"+arm64.Digest))
+	require.NoError(t, err)
+
+	img, err := c.Inspect(context.Background(), dst.ref("prod/app:1.0"))
+	require.NoError(t, err)
+	require.Equal(t, MediaTypeOCIIndex, img.MediaType)
+	require.Equal(t, []string{"linux/amd64", "linux/arm64/v8"}, []string{img.Platforms[0].String(), img.Platforms[1].String()})
+
+	// existing blobs are skipped
+	_, err = c.Copy(context.Background(), src.ref("team/app:1.0"), dst.ref("prod/app:latest"))
+	require.NoError(t, err)
+	require.Equal(t, 4, dst.uploads)
+}
+
+func TestClientCopyMount(t *testing.T) {
+	f := newFakeRegistry(t)
+	image := f.putImage("staging/app", "1.0", "amd64")
+
+	c := f.client()
+
+	// same repository, only the manifest is put
+	m, err := c.Copy(context.Background(), f.ref("staging/app:1.0"), f.ref("staging/app:stable"))
+	require.NoError(t, err)
+	require.Equal(t, image.Digest, m.Digest)
+
+	// same registry, blobs are mounted
+	_, err = c.Copy(context.Background(), f.ref("staging/app:1.0"), f.ref("prod/app:1.0"))
+	require.NoError(t, err)
+	require.Equal(t, 2, f.mounts)
+	require.Zero(t, f.uploads)
+
+	img, err := c.Inspect(context.Background(), f.ref("prod/app:1.0"))
+	require.NoError(t, err)
+	require.Equal(t, image.Digest, img.Digest)
+	require.Equal(t, "infra", img.Labels["team"])
+	require.Equal(t, 2024, img.Created.Year())
+	require.Equal(t, "linux/amd64", img.Platforms[0].String())
+}
+
+func TestClientErrors(t *testing.T) {
+	f := newFakeRegistry(t)
+
+	_, err := f.client().GetManifest(context.Background(), f.ref("missing/app:1.0"))
+	require.Error(t, err)
+	require.True(t, IsNotFound(err))
+	require.Contains(t, err.Error(), "MANIFEST_UNKNOWN manifest unknown")
+
+	// wrong credentials
+	c := NewClient(Options{})
+	_, err = c.GetManifest(context.Background(), f.ref("missing/app:1.0"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to get token")
+}
@@ -0,0 +1,61 @@
+package fastregistry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Credential is the username and password of a registry
+type Credential struct {
+	Username string
+	Password string
+}
+
+// DockerConfigAuth is an item of auths in docker config.json
+type DockerConfigAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// DockerConfig is the subset of docker config.json used by fastregistry
+type DockerConfig struct {
+	Auths map[string]DockerConfigAuth `json:"auths"`
+}
+
+// LoadDockerConfig loads a docker config.json file
+func LoadDockerConfig(file string) (cfg DockerConfig, err error) {
+	var buf []byte
+	if buf, err = os.ReadFile(file); err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &cfg)
+	return
+}
+
+// normalizeAuthKey converts keys of auths like "https://index.docker.io/v1/" into registry host
+func normalizeAuthKey(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+	return normalizeRegistry(key)
+}
+
+// Credential returns the credential of registry, empty if not found
+func (cfg DockerConfig) Credential(registry string) (cred Credential) {
+	registry = normalizeRegistry(registry)
+	for key, item := range cfg.Auths {
+		if normalizeAuthKey(key) != registry {
+			continue
+		}
+		cred.Username, cred.Password = item.Username, item.Password
+		if item.Auth != "" {
+			if buf, err := base64.StdEncoding.DecodeString(item.Auth); err == nil {
+				cred.Username, cred.Password, _ = strings.Cut(string(buf), ":")
+			}
+		}
+		return
+	}
+	return
+}
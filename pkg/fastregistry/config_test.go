@@ -0,0 +1,18 @@
+package fastregistry
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerConfigCredential(t *testing.T) {
+	cfg := DockerConfig{Auths: map[string]DockerConfigAuth{
+		"https://index.docker.io/v1/": {Auth: base64.StdEncoding.EncodeToString([]byte("hub:secret"))},
+		"registry.example.com":        {Username: "user", Password: "pass"},
+	}}
+	require.Equal(t, Credential{Username: "hub", Password: "secret"}, cfg.Credential("docker.io"))
+	require.Equal(t, Credential{Username: "user", Password: "pass"}, cfg.Credential("registry.example.com"))
+	require.Equal(t, Credential{}, cfg.Credential("other.example.com"))
+}
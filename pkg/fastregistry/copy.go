@@ -0,0 +1,130 @@
+package fastregistry
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// isForeignLayer checks if a layer is not distributable
+func isForeignLayer(desc Descriptor) bool {
+	return len(desc.URLs) > 0 || strings.Contains(desc.MediaType, "foreign") || strings.Contains(desc.MediaType, "nondistributable")
+}
+
+// copyContent copies blobs and child manifests referenced by the manifest from src to dst
+func (c *Client) copyContent(ctx context.Context, src Reference, dst Reference, m *Manifest) (err error) {
+	// blobs are shared in the same repository
+	if src.Registry == dst.Registry && src.Repository == dst.Repository {
+		return
+	}
+
+	if m.IsIndex() {
+		for _, desc := range m.Manifests {
+			var child *Manifest
+			if child, err = c.GetManifest(ctx, src.WithDigest(desc.Digest)); err != nil {
+				return
+			}
+			if err = c.copyContent(ctx, src, dst, child); err != nil {
+				return
+			}
+			if err = c.PutManifest(ctx, dst.WithDigest(desc.Digest), child); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	for _, desc := range append([]Descriptor{m.Config}, m.Layers...) {
+		if isForeignLayer(desc) {
+			continue
+		}
+		if err = c.CopyBlob(ctx, src, dst, desc); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Copy copies an image with all platforms, keeping the digest
+func (c *Client) Copy(ctx context.Context, src Reference, dst Reference) (m *Manifest, err error) {
+	if m, err = c.GetManifest(ctx, src); err != nil {
+		return
+	}
+	if err = c.copyContent(ctx, src, dst, m); err != nil {
+		return
+	}
+	if err = c.PutManifest(ctx, dst, m); err != nil {
+		return
+	}
+	return
+}
+
+// Image is the result of Inspect
+type Image struct {
+	Reference Reference
+	MediaType string
+	Digest    string
+	Size      int64
+	// Platforms are platforms of a manifest list, or the platform of a single image
+	Platforms []Platform
+	// Created and Labels are from the config of a single image
+	Created time.Time
+	Labels  map[string]string
+}
+
+// Inspect gets the manifest of image, and the config for a single image
+func (c *Client) Inspect(ctx context.Context, ref Reference) (img *Image, err error) {
+	var m *Manifest
+	if m, err = c.GetManifest(ctx, ref); err != nil {
+		return
+	}
+
+	img = &Image{
+		Reference: ref,
+		MediaType: m.MediaType,
+		Digest:    m.Digest,
+		Size:      int64(len(m.Body)),
+	}
+
+	if m.IsIndex() {
+		for _, desc := range m.Manifests {
+			img.Size += desc.Size
+			if desc.Platform != nil && desc.Platform.OS != "unknown" {
+				img.Platforms = append(img.Platforms, *desc.Platform)
+			}
+		}
+		return
+	}
+
+	img.Size += m.Config.Size
+	for _, desc := range m.Layers {
+		img.Size += desc.Size
+	}
+
+	var body io.ReadCloser
+	if body, _, err = c.GetBlob(ctx, ref, m.Config.Digest); err != nil {
+		return
+	}
+	defer body.Close()
+
+	var config struct {
+		Created      time.Time `json:"created"`
+		Architecture string    `json:"architecture"`
+		OS           string    `json:"os"`
+		Variant      string    `json:"variant"`
+		Config       struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	if err = json.NewDecoder(body).Decode(&config); err != nil {
+		return
+	}
+	img.Created = config.Created
+	img.Labels = config.Config.Labels
+	if config.OS != "" {
+		img.Platforms = []Platform{{Architecture: config.Architecture, OS: config.OS, Variant: config.Variant}}
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package fastregistry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultRegistry is the registry of images without a host
+	DefaultRegistry = "docker.io"
+	// DefaultTag is the tag of images without tag and digest
+	DefaultTag = "latest"
+
+	// dockerHubHost is the API host of DefaultRegistry
+	dockerHubHost = "registry-1.docker.io"
+)
+
+var (
+	regexpRepository = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	regexpTag        = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	regexpDigest     = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+)
+
+// Reference is a parsed image reference, like "registry.example.com/team/app:1.0@sha256:..."
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// normalizeRegistry converts aliases of Docker Hub into DefaultRegistry
+func normalizeRegistry(registry string) string {
+	switch registry {
+	case "index.docker.io", dockerHubHost:
+		return DefaultRegistry
+	}
+	return registry
+}
+
+// ParseReference parses an image reference with defaults
+func ParseReference(s string) (ref Reference, err error) {
+	name := s
+	if before, digest, ok := strings.Cut(name, "@"); ok {
+		if !regexpDigest.MatchString(digest) {
+			err = fmt.Errorf("invalid digest in image reference %q", s)
+			return
+		}
+		name, ref.Digest = before, digest
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !regexpTag.MatchString(ref.Tag) {
+			err = fmt.Errorf("invalid tag in image reference %q", s)
+			return
+		}
+	}
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.Registry, name = normalizeRegistry(first), rest
+	} else {
+		ref.Registry = DefaultRegistry
+	}
+	if ref.Registry == DefaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !regexpRepository.MatchString(name) {
+		err = fmt.Errorf("invalid repository in image reference %q", s)
+		return
+	}
+	ref.Repository = name
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	return
+}
+
+// IsValidTag checks if a string is a valid tag
+func IsValidTag(tag string) bool {
+	return regexpTag.MatchString(tag)
+}
+
+// Name returns the registry and repository, like "registry.example.com/team/app"
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// String returns the full reference
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// WithTag returns the reference of the same repository with the tag
+func (r Reference) WithTag(tag string) Reference {
+	return Reference{Registry: r.Registry, Repository: r.Repository, Tag: tag}
+}
+
+// WithDigest returns the reference of the same repository with the digest
+func (r Reference) WithDigest(digest string) Reference {
+	return Reference{Registry: r.Registry, Repository: r.Repository, Digest: digest}
+}
+
+// identifier returns the digest if set, otherwise the tag, used in the manifest url
+func (r Reference) identifier() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
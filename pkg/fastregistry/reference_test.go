@@ -0,0 +1,33 @@
+package fastregistry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReference(t *testing.T) {
+	for s, expected := range map[string]Reference{
+		"ubuntu":                                     {Registry: "docker.io", Repository: "library/ubuntu", Tag: "latest"},
+		"yankeguo/fastci:1.0":                        {Registry: "docker.io", Repository: "yankeguo/fastci", Tag: "1.0"},
+		"index.docker.io/library/ubuntu:24":          {Registry: "docker.io", Repository: "library/ubuntu", Tag: "24"},
+		"localhost:5000/app":                         {Registry: "localhost:5000", Repository: "app", Tag: "latest"},
+		"registry.example.com/team/app:1@sha256:abc": {Registry: "registry.example.com", Repository: "team/app", Tag: "1", Digest: "sha256:abc"},
+		"registry.example.com/team/app@sha256:abc":   {Registry: "registry.example.com", Repository: "team/app", Digest: "sha256:abc"},
+	} {
+		ref, err := ParseReference(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, ref, s)
+	}
+
+	for _, s := range []string{"", "UPPER/case", "app:", "app@latest", "registry.example.com/app:bad/tag"} {
+		_, err := ParseReference(s)
+		require.Error(t, err, s)
+	}
+
+	ref, err := ParseReference("registry.example.com/team/app:1")
+	require.NoError(t, err)
+	require.Equal(t, "registry.example.com/team/app:1", ref.String())
+	require.Equal(t, "registry.example.com/team/app:2", ref.WithTag("2").String())
+	require.Equal(t, "registry.example.com/team/app@sha256:abc", ref.WithDigest("sha256:abc").String())
+}
@@ -0,0 +1,535 @@
+package fastyaml
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	indentDefault = 2
+
+	mergeKey = "<<"
+)
+
+// Path is a path to a node in a YAML document, elements are either string keys or int indexes
+type Path []any
+
+// ParsePath parses a path like "a.b[0].c" or `a["b.c"][1]`
+func ParsePath(s string) (p Path, err error) {
+	var key strings.Builder
+
+	flush := func() {
+		if key.Len() > 0 {
+			p = append(p, key.String())
+			key.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '.':
+			flush()
+		case '[':
+			flush()
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				err = fmt.Errorf("invalid path %q: missing ]", s)
+				return
+			}
+			inner := s[i+1 : i+end]
+			if strings.HasPrefix(inner, `"`) || strings.HasPrefix(inner, `'`) {
+				if len(inner) < 2 || inner[len(inner)-1] != inner[0] {
+					err = fmt.Errorf("invalid path %q: unterminated quote", s)
+					return
+				}
+				p = append(p, inner[1:len(inner)-1])
+			} else {
+				var idx int
+				if idx, err = strconv.Atoi(inner); err != nil {
+					err = fmt.Errorf("invalid path %q: invalid index %q", s, inner)
+					return
+				}
+				p = append(p, idx)
+			}
+			i += end
+		default:
+			key.WriteByte(c)
+		}
+	}
+	flush()
+	return
+}
+
+func (p Path) String() string {
+	var sb strings.Builder
+	for _, item := range p {
+		switch v := item.(type) {
+		case int:
+			sb.WriteString("[" + strconv.Itoa(v) + "]")
+		default:
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			sb.WriteString(fmt.Sprint(v))
+		}
+	}
+	return sb.String()
+}
+
+// Document is a YAML document which preserves comments, key order and anchors across edits
+type Document struct {
+	root   *yaml.Node
+	indent int
+	dirty  bool
+}
+
+// detectIndent returns the smallest non-zero indentation of the source
+func detectIndent(buf []byte) int {
+	indent := 0
+	for _, line := range strings.Split(string(buf), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if n := len(line) - len(trimmed); n > 0 && (indent == 0 || n < indent) {
+			indent = n
+		}
+	}
+	if indent < 2 {
+		indent = indentDefault
+	}
+	return indent
+}
+
+// Parse parses a YAML document, an empty source results in an empty mapping
+func Parse(buf []byte) (doc *Document, err error) {
+	doc = &Document{root: &yaml.Node{}, indent: detectIndent(buf)}
+	if err = yaml.Unmarshal(buf, doc.root); err != nil {
+		return
+	}
+	if doc.root.Kind == 0 {
+		doc.root = &yaml.Node{
+			Kind:    yaml.DocumentNode,
+			Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}},
+		}
+	}
+	return
+}
+
+// fixMergeKeys clears the tag of merge keys, yaml.v3 encodes them as "!!merge <<" otherwise
+func fixMergeKeys(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if key := node.Content[i]; key.Kind == yaml.ScalarNode && key.Value == mergeKey && key.Tag == "!!merge" {
+				key.Tag = ""
+			}
+		}
+	}
+	for _, child := range node.Content {
+		fixMergeKeys(child)
+	}
+}
+
+// Bytes encodes the document back to YAML
+func (d *Document) Bytes() (buf []byte, err error) {
+	fixMergeKeys(d.root)
+
+	out := &bytes.Buffer{}
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(d.indent)
+	if err = enc.Encode(d.root); err != nil {
+		return
+	}
+	if err = enc.Close(); err != nil {
+		return
+	}
+	buf = out.Bytes()
+	return
+}
+
+// Value decodes the whole document as plain values
+func (d *Document) Value() (out any, err error) {
+	err = d.root.Decode(&out)
+	return
+}
+
+// Dirty returns true if the document has been modified since parsed
+func (d *Document) Dirty() bool {
+	return d.dirty
+}
+
+func (d *Document) body() *yaml.Node {
+	return d.root.Content[0]
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// mappingIndex returns the index of the key node in mapping content, or -1
+func mappingIndex(node *yaml.Node, key string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookup finds the child of node, following aliases and merge keys for mappings
+func lookup(node *yaml.Node, item any) (child *yaml.Node, err error) {
+	node = resolveAlias(node)
+	switch key := item.(type) {
+	case string:
+		if node.Kind != yaml.MappingNode {
+			err = fmt.Errorf("cannot lookup key %q in non-mapping node", key)
+			return
+		}
+		if i := mappingIndex(node, key); i >= 0 {
+			child = node.Content[i+1]
+			return
+		}
+		if i := mappingIndex(node, mergeKey); i >= 0 {
+			merges := []*yaml.Node{resolveAlias(node.Content[i+1])}
+			if merges[0].Kind == yaml.SequenceNode {
+				merges = merges[0].Content
+			}
+			for _, merge := range merges {
+				if child, _ = lookup(merge, key); child != nil {
+					return
+				}
+			}
+		}
+	case int:
+		if node.Kind != yaml.SequenceNode {
+			err = fmt.Errorf("cannot lookup index %d in non-sequence node", key)
+			return
+		}
+		if key < 0 {
+			key += len(node.Content)
+		}
+		if key >= 0 && key < len(node.Content) {
+			child = node.Content[key]
+		}
+	default:
+		err = fmt.Errorf("invalid path element: %v", item)
+	}
+	return
+}
+
+// find returns the node at path, or nil if not exists
+func (d *Document) find(p Path) (node *yaml.Node, err error) {
+	node = d.body()
+	for _, item := range p {
+		if node, err = lookup(node, item); err != nil || node == nil {
+			return
+		}
+	}
+	return
+}
+
+// Get decodes the value at path, exists is false if the path is not found
+func (d *Document) Get(p Path) (out any, exists bool, err error) {
+	var node *yaml.Node
+	if node, err = d.find(p); err != nil || node == nil {
+		return
+	}
+	exists = true
+	err = node.Decode(&out)
+	return
+}
+
+// encodeNode encodes a plain value into a YAML node
+func encodeNode(val any) (node *yaml.Node, err error) {
+	node = &yaml.Node{}
+	if err = node.Encode(val); err != nil {
+		return
+	}
+	clearFlowStyle(node)
+	return
+}
+
+// clearFlowStyle makes collections block style
+func clearFlowStyle(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode {
+		node.Style &^= yaml.FlowStyle
+	}
+	for _, child := range node.Content {
+		clearFlowStyle(child)
+	}
+}
+
+// replaceNode replaces the node with value in place, keeping comments, anchor and scalar style
+func replaceNode(node *yaml.Node, val any) (err error) {
+	var next *yaml.Node
+	if next, err = encodeNode(val); err != nil {
+		return
+	}
+	next.HeadComment = node.HeadComment
+	next.LineComment = node.LineComment
+	next.FootComment = node.FootComment
+	if node.Kind != yaml.AliasNode {
+		next.Anchor = node.Anchor
+	}
+	if node.Kind == yaml.ScalarNode && next.Kind == yaml.ScalarNode && node.Tag == next.Tag {
+		next.Style = node.Style
+	}
+	*node = *next
+	return
+}
+
+// Set sets the value at path, intermediate mappings are created if missing or null
+func (d *Document) Set(p Path, val any) (err error) {
+	d.dirty = true
+
+	if len(p) == 0 {
+		return replaceNode(d.body(), val)
+	}
+
+	node := d.body()
+
+	for i, item := range p {
+		last := i == len(p)-1
+
+		if node.Kind == yaml.AliasNode {
+			// copy aliased content, so that the anchor is not modified
+			var m any
+			if err = node.Decode(&m); err != nil {
+				return
+			}
+			if err = replaceNode(node, m); err != nil {
+				return
+			}
+		}
+		if _, ok := item.(string); ok && node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+			// a null value, like a bare "resources:", becomes an empty mapping
+			*node = yaml.Node{
+				Kind:        yaml.MappingNode,
+				Tag:         "!!map",
+				Anchor:      node.Anchor,
+				HeadComment: node.HeadComment,
+				LineComment: node.LineComment,
+				FootComment: node.FootComment,
+			}
+		}
+
+		var child *yaml.Node
+		if child, err = lookup(node, item); err != nil {
+			return
+		}
+
+		if child != nil && (node.Kind != yaml.MappingNode || mappingIndex(node, item.(string)) >= 0) {
+			if last {
+				return replaceNode(child, val)
+			}
+			node = child
+			continue
+		}
+
+		// child is missing, or only exists via merge key
+		key, ok := item.(string)
+		if !ok {
+			err = fmt.Errorf("index %v out of range at %s", item, p[:i+1])
+			return
+		}
+
+		var next *yaml.Node
+		if last {
+			if next, err = encodeNode(val); err != nil {
+				return
+			}
+		} else {
+			next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			if child != nil {
+				// copy merged content, so that merge source is not modified
+				var m any
+				if err = child.Decode(&m); err != nil {
+					return
+				}
+				if next, err = encodeNode(m); err != nil {
+					return
+				}
+			}
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, next)
+		node = next
+	}
+	return
+}
+
+// Delete removes the value at path, returns false if the path is not found
+func (d *Document) Delete(p Path) (deleted bool, err error) {
+	if len(p) == 0 {
+		err = errors.New("cannot delete the document root")
+		return
+	}
+	var parent *yaml.Node
+	if parent, err = d.find(p[:len(p)-1]); err != nil || parent == nil {
+		return
+	}
+	parent = resolveAlias(parent)
+	switch item := p[len(p)-1].(type) {
+	case string:
+		if parent.Kind != yaml.MappingNode {
+			err = fmt.Errorf("cannot delete key %q in non-mapping node", item)
+			return
+		}
+		if i := mappingIndex(parent, item); i >= 0 {
+			parent.Content = append(parent.Content[:i], parent.Content[i+2:]...)
+			deleted, d.dirty = true, true
+		}
+	case int:
+		if parent.Kind != yaml.SequenceNode {
+			err = fmt.Errorf("cannot delete index %d in non-sequence node", item)
+			return
+		}
+		if item < 0 {
+			item += len(parent.Content)
+		}
+		if item >= 0 && item < len(parent.Content) {
+			parent.Content = append(parent.Content[:item], parent.Content[item+1:]...)
+			deleted, d.dirty = true, true
+		}
+	}
+	return
+}
+
+// Insert inserts before index, or appends if out of range
+func (d *Document) Insert(p Path, index int, val any) (err error) {
+	var node *yaml.Node
+	if node, err = d.find(p); err != nil {
+		return
+	}
+	if node == nil {
+		if err = d.Set(p, []any{}); err != nil {
+			return
+		}
+		if node, err = d.find(p); err != nil {
+			return
+		}
+	}
+	node = resolveAlias(node)
+	if node.Kind != yaml.SequenceNode {
+		err = fmt.Errorf("cannot insert into non-sequence node at %s", p)
+		return
+	}
+
+	var next *yaml.Node
+	if next, err = encodeNode(val); err != nil {
+		return
+	}
+
+	d.dirty = true
+
+	if index < 0 || index >= len(node.Content) {
+		node.Content = append(node.Content, next)
+	} else {
+		node.Content = append(node.Content[:index], append([]*yaml.Node{next}, node.Content[index:]...)...)
+	}
+	return
+}
+
+// Apply applies changes between old and new, keeping formatting
+func (d *Document) Apply(old any, new any) error {
+	if reflect.DeepEqual(old, new) {
+		return nil
+	}
+	d.dirty = true
+	return applyChanges(d.body(), old, new)
+}
+
+func applyChanges(node *yaml.Node, old any, new any) (err error) {
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+
+	// never modify through an alias, since the anchor is shared
+	if node.Kind == yaml.AliasNode {
+		return replaceNode(node, new)
+	}
+
+	oldMap, okOldMap := old.(map[string]any)
+	newMap, okNewMap := new.(map[string]any)
+	if okOldMap && okNewMap && node.Kind == yaml.MappingNode {
+		// keys are visited in sorted order, new keys are appended in a stable order
+		for _, key := range slices.Sorted(maps.Keys(newMap)) {
+			newVal := newMap[key]
+			oldVal, exists := oldMap[key]
+			if i := mappingIndex(node, key); exists && i >= 0 {
+				if err = applyChanges(node.Content[i+1], oldVal, newVal); err != nil {
+					return
+				}
+				continue
+			}
+			if exists && reflect.DeepEqual(oldVal, newVal) {
+				// inherited from merge key and unchanged
+				continue
+			}
+			var next *yaml.Node
+			if next, err = encodeNode(newVal); err != nil {
+				return
+			}
+			if i := mappingIndex(node, key); i >= 0 {
+				node.Content[i+1] = next
+			} else {
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, next)
+			}
+		}
+		for key := range oldMap {
+			if _, exists := newMap[key]; exists {
+				continue
+			}
+			if i := mappingIndex(node, key); i >= 0 {
+				node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			}
+		}
+		return
+	}
+
+	oldSlice, okOldSlice := old.([]any)
+	newSlice, okNewSlice := new.([]any)
+	if okOldSlice && okNewSlice && node.Kind == yaml.SequenceNode && len(node.Content) == len(oldSlice) {
+		for i, newVal := range newSlice {
+			if i >= len(oldSlice) {
+				var next *yaml.Node
+				if next, err = encodeNode(newVal); err != nil {
+					return
+				}
+				node.Content = append(node.Content, next)
+				continue
+			}
+			if err = applyChanges(node.Content[i], oldSlice[i], newVal); err != nil {
+				return
+			}
+		}
+		if len(newSlice) < len(node.Content) {
+			node.Content = node.Content[:len(newSlice)]
+		}
+		return
+	}
+
+	return replaceNode(node, new)
+}
+
+// Normalize converts a value to the plain form of encoding/json
+func Normalize(val any) (out any, err error) {
+	var buf []byte
+	if buf, err = json.Marshal(val); err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &out)
+	return
+}
@@ -0,0 +1,198 @@
+package fastyaml
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testSource = `# head comment
+app:
+  # image of the app
+  image: "app:1" # current image
+  replicas: 2
+  ports:
+    - 80
+    - 443
+base: &base
+  cpu: 100m
+worker:
+  <<: *base
+  image: worker:1
+`
+
+func TestParsePath(t *testing.T) {
+	p, err := ParsePath(`a.b[0].c["d.e"]['f'][-1]`)
+	require.NoError(t, err)
+	require.Equal(t, Path{"a", "b", 0, "c", "d.e", "f", -1}, p)
+	require.Equal(t, `a.b[0].c.d.e.f[-1]`, p.String())
+
+	_, err = ParsePath("a[0")
+	require.Error(t, err)
+
+	_, err = ParsePath("a[x]")
+	require.Error(t, err)
+}
+
+func TestDocumentGet(t *testing.T) {
+	doc, err := Parse([]byte(testSource))
+	require.NoError(t, err)
+
+	val, exists, err := doc.Get(Path{"app", "image"})
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, "app:1", val)
+
+	val, exists, err = doc.Get(Path{"app", "ports", 1})
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, 443, val)
+
+	val, exists, err = doc.Get(Path{"worker", "cpu"})
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, "100m", val)
+
+	_, exists, err = doc.Get(Path{"app", "missing"})
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	_, _, err = doc.Get(Path{"app", "image", "x"})
+	require.Error(t, err)
+}
+
+func TestDocumentSetDeleteInsert(t *testing.T) {
+	doc, err := Parse([]byte(testSource))
+	require.NoError(t, err)
+
+	require.NoError(t, doc.Set(Path{"app", "image"}, "app:2"))
+	require.NoError(t, doc.Set(Path{"app", "env", "DEBUG"}, "true"))
+	require.NoError(t, doc.Set(Path{"worker", "cpu"}, "200m"))
+	require.NoError(t, doc.Insert(Path{"app", "ports"}, 0, 8080))
+	require.NoError(t, doc.Insert(Path{"app", "hosts"}, -1, "example.com"))
+
+	deleted, err := doc.Delete(Path{"app", "replicas"})
+	require.NoError(t, err)
+	require.True(t, deleted)
+
+	deleted, err = doc.Delete(Path{"app", "missing"})
+	require.NoError(t, err)
+	require.False(t, deleted)
+
+	buf, err := doc.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, `# head comment
+app:
+  # image of the app
+  image: "app:2" # current image
+  ports:
+    - 8080
+    - 80
+    - 443
+  env:
+    DEBUG: "true"
+  hosts:
+    - example.com
+base: &base
+  cpu: 100m
+worker:
+  <<: *base
+  image: worker:1
+  cpu: 200m
+`, string(buf))
+}
+
+func TestDocumentSetAlias(t *testing.T) {
+	doc, err := Parse([]byte("defaults: &d\n  tag: v1\napp: *d\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, doc.Set(Path{"app", "tag"}, "v2"))
+
+	buf, err := doc.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, "defaults: &d\n  tag: v1\napp:\n  tag: v2\n", string(buf))
+}
+
+func TestDocumentSetNull(t *testing.T) {
+	doc, err := Parse([]byte("resources: # limits\nreplicas: ~\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, doc.Set(Path{"resources", "limits", "cpu"}, "100m"))
+	require.NoError(t, doc.Set(Path{"replicas", "count"}, 2))
+	require.Error(t, doc.Insert(Path{"replicas", "count"}, 0, 1))
+
+	buf, err := doc.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, "resources: # limits\n  limits:\n    cpu: 100m\nreplicas:\n  count: 2\n", string(buf))
+}
+
+func TestDocumentApply(t *testing.T) {
+	doc, err := Parse([]byte(testSource))
+	require.NoError(t, err)
+
+	old, err := doc.Value()
+	require.NoError(t, err)
+	old, err = Normalize(old)
+	require.NoError(t, err)
+
+	updated, err := Normalize(old)
+	require.NoError(t, err)
+
+	m := updated.(map[string]any)
+	m["app"].(map[string]any)["image"] = "app:3"
+	m["app"].(map[string]any)["ports"] = []any{float64(80)}
+	delete(m["app"].(map[string]any), "replicas")
+	m["worker"].(map[string]any)["image"] = "worker:3"
+	m["extra"] = map[string]any{"enabled": true}
+
+	require.NoError(t, doc.Apply(old, old))
+	require.False(t, doc.Dirty())
+
+	require.NoError(t, doc.Apply(old, updated))
+	require.True(t, doc.Dirty())
+
+	buf, err := doc.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, `# head comment
+app:
+  # image of the app
+  image: "app:3" # current image
+  ports:
+    - 80
+base: &base
+  cpu: 100m
+worker:
+  <<: *base
+  image: worker:3
+extra:
+  enabled: true
+`, string(buf))
+}
+
+func TestDocumentApplyStableOrder(t *testing.T) {
+	for range 20 {
+		doc, err := Parse([]byte("a: 1\n"))
+		require.NoError(t, err)
+		require.NoError(t, doc.Apply(
+			map[string]any{"a": float64(1)},
+			map[string]any{"a": float64(1), "e": float64(4), "c": float64(2), "b": float64(1), "d": float64(3)},
+		))
+		buf, err := doc.Bytes()
+		require.NoError(t, err)
+		require.Equal(t, "a: 1\nb: 1\nc: 2\nd: 3\ne: 4\n", string(buf))
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	doc, err := Parse(nil)
+	require.NoError(t, err)
+	require.NoError(t, doc.Set(Path{"a"}, 1))
+	buf, err := doc.Bytes()
+	require.NoError(t, err)
+	require.Equal(t, "a: 1\n", string(buf))
+}
+
+func TestDetectIndent(t *testing.T) {
+	require.Equal(t, 4, detectIndent([]byte("a:\n    b: 1\n")))
+	require.Equal(t, 2, detectIndent([]byte("a: 1\n")))
+}
@@ -7,33 +7,60 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robertkrimen/otto"
 	_ "github.com/robertkrimen/otto/underscore"
+	"github.com/yankeguo/fastci/pkg/fastforge"
 	"github.com/yankeguo/fastci/pkg/fastjs"
 	"github.com/yankeguo/rg"
 )
 
+const (
+	codingBaseURLDefault = "https://e.coding.net"
+)
+
+var (
+	// scriptName matches names of scripts
+	scriptName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+)
+
 type Runner struct {
 	vm  *otto.Otto
 	env *otto.Object
 
+	// ctx is the context of current execution
+	ctx context.Context
+	// step is the name of the running step, kept when the step is interrupted
+	step string
+	// cancel cancels the context of current execution with a cause
+	cancel context.CancelCauseFunc
+	// started is the start time of current execution
+	started time.Time
+	// timeoutTimer cancels the execution when the pipeline timeout is reached
+	timeoutTimer *time.Timer
+
 	skipClean bool
 	tempDirs  []string
 
 	state struct {
-		shell []string
+		shell   []string
+		timeout time.Duration
+		workdir string
 
 		script struct {
-			path string
+			path  string
+			named map[string]*namedScript
 		}
 
 		docker struct {
@@ -42,6 +69,21 @@ type Runner struct {
 			dockerfilePath string
 			buildContext   string
 			buildArg       *otto.Object
+			platforms      []string
+			cache          dockerCacheOptions
+			secrets        []dockerBuildMount
+			ssh            []dockerBuildMount
+			options        dockerBuildOptions
+			// registries are set by useDockerRegistries, images are mirrored to each of them
+			registries []dockerRegistry
+			// mergedConfig is the docker config with credentials of registries
+			mergedConfig dockerMergedConfig
+			// backend is set by useDockerBackend, empty for auto-detection
+			backend string
+			// fingerprint of the last build with skipIfExists
+			fingerprint string
+			// digests are digests of images built or pushed, by image
+			digests map[string]*dockerImageDigest
 		}
 
 		kubernetes struct {
@@ -53,17 +95,37 @@ type Runner struct {
 				kind      string
 				container string
 				init      bool
+				wait      bool
+				timeout   time.Duration
+				// digest deploys the image by the immutable reference "repo@sha256:..."
+				digest bool
+			}
+		}
+
+		git struct {
+			values struct {
+				url      string
+				branch   string
+				file     string
+				update   otto.Value
+				username string
+				password string
+
+				mergeRequest gitMergeRequestOptions
 			}
 		}
 
 		coding struct {
 			values struct {
+				baseURL string
 				team    string
 				project string
 				repo    string
 				branch  string
 				file    string
 				update  otto.Value
+
+				mergeRequest gitMergeRequestOptions
 			}
 		}
 	}
@@ -116,77 +178,195 @@ func (r *Runner) useDeployer(call otto.FunctionCall) otto.Value {
 	return rg.Must(fastjs.Array(r, r.state.docker.images)).Value()
 }
 
+// namedScript is defined by useScript(name, content)
+type namedScript struct {
+	path  string
+	shell []string
+	env   []string
+}
+
+func (r *Runner) useScript(call otto.FunctionCall) otto.Value {
+	// useScript(name, content), otherwise the default script
+	name, def := call.Argument(0), call.Argument(1)
+	if len(call.ArgumentList) == 2 && name.IsString() && def.IsString() && scriptName.MatchString(name.String()) {
+		rg.Must0(fmt.Errorf(`ambiguous useScript(%q, %q), use useScript(%q, [...]) or useScript(%q, {content: ...}) for a named script, or useScript([...]) for lines of the default script`, name.String(), def.String(), name.String(), name.String()))
+	}
+	if len(call.ArgumentList) != 2 || !name.IsString() || !def.IsObject() {
+		return fastjs.GetterSetterForLongString(r, &r.state.script.path, "script", r.persistScript)(call)
+	}
+
+	script := &namedScript{}
+	fastjs.GetterSetterForLongString(r, &script.path, "script "+name.String(), r.persistScript)(otto.FunctionCall{
+		Otto:         call.Otto,
+		ArgumentList: []otto.Value{def},
+	})
+	if script.path == "" {
+		rg.Must0(fmt.Errorf("script %s is empty", name.String()))
+	}
+	if def.Class() != "Array" {
+		rg.Must0(fastjs.LoadStringSliceField(&script.shell, def.Object(), "shell"))
+		rg.Must0(loadEnvField(&script.env, def.Object(), "env"))
+	}
+
+	if r.state.script.named == nil {
+		r.state.script.named = map[string]*namedScript{}
+	}
+	r.state.script.named[name.String()] = script
+
+	return rg.Must(otto.ToValue(script.path))
+}
+
+func (r *Runner) persistScript(buf []byte, name string) (out string, err error) {
+	out, _, err = r.createTempFile("script.sh", bytes.TrimSpace(buf))
+	return
+}
+
 func (r *Runner) runScript(call otto.FunctionCall) otto.Value {
-	shell := r.state.shell
+	script := &namedScript{path: r.state.script.path}
+
+	// runScript(name, opts) or runScript(opts)
+	args := call.ArgumentList
+	if len(args) > 0 && args[0].IsString() {
+		name := args[0].String()
+		if script = r.state.script.named[name]; script == nil {
+			rg.Must0(fmt.Errorf("script %s is not defined, use useScript(name, content) first", name))
+		}
+		args = args[1:]
+	}
+
+	var (
+		opts          commandOptions
+		containerOpts containerOptions
+	)
+	if len(args) > 0 && args[0].IsObject() {
+		rg.Must0(loadCommandOptions(&opts, args[0].Object()))
+		rg.Must0(loadContainerOptions(&containerOpts, args[0].Object()))
+	}
+
+	shell := script.shell
 	if len(shell) == 0 {
-		shell = []string{"bash"}
+		shell = r.state.shell
+	}
+	if len(shell) == 0 {
+		// bash is not available in many images
+		if containerOpts.image != "" {
+			shell = []string{"sh"}
+		} else {
+			shell = []string{"bash"}
+		}
 	}
 
-	buf := rg.Must(os.ReadFile(r.state.script.path))
+	buf := rg.Must(os.ReadFile(r.resolvePath(script.path)))
 
-	log.Println("run script:", r.state.script.path, "\n", string(buf))
+	log.Println("run script:", script.path, "\n", string(buf))
 
-	cmd := exec.Command(shell[0], shell[1:]...)
-	cmd.Env = rg.Must(r.createEnviron())
+	// later values take precedence
+	env := append(rg.Must(r.createEnviron()), script.env...)
+
+	var cmd *exec.Cmd
+	if containerOpts.image != "" {
+		var name string
+		cmd, name = rg.Must2(r.createContainerCommand(containerOpts, shell, env))
+		defer r.removeCancelledContainer(name, env)
+	} else {
+		cmd = exec.Command(shell[0], shell[1:]...)
+		cmd.Dir = r.state.workdir
+		cmd.Env = env
+	}
 	cmd.Stdin = bytes.NewReader(buf)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	rg.Must0(cmd.Run())
 
-	return otto.NullValue()
+	res := rg.Must(r.runCommandForResult(cmd, opts))
+
+	if !opts.capture && !opts.allowFailure {
+		return otto.NullValue()
+	}
+	return rg.Must(fastjs.Object(r, res)).Value()
 }
 
-func (r *Runner) runDockerBuild(call otto.FunctionCall) otto.Value {
-	if len(r.state.docker.images) == 0 {
-		rg.Must0(errors.New("no images to build"))
+func (r *Runner) exec(call otto.FunctionCall) otto.Value {
+	var argv []string
+	if arg := call.Argument(0); arg.IsObject() && arg.Class() == "Array" {
+		rg.Must0(json.Unmarshal(rg.Must(arg.Object().MarshalJSON()), &argv))
+	}
+	if len(argv) == 0 {
+		rg.Must0(errors.New("exec requires a non-empty array of program and arguments"))
 		return otto.UndefinedValue()
 	}
-	var args []string
 
-	// config
-	if r.state.docker.configPath != "" {
-		args = append(args, "--config", r.state.docker.configPath)
+	var (
+		opts  commandOptions
+		stdin string
+		env   []string
+	)
+	if arg := call.Argument(1); arg.IsObject() {
+		obj := arg.Object()
+		rg.Must0(loadCommandOptions(&opts, obj))
+		rg.Must0(fastjs.LoadStringField(&stdin, obj, "stdin"))
+		rg.Must0(loadEnvField(&env, obj, "env"))
 	}
 
-	// command
-	args = append(args, "buildx", "build", "--load")
+	log.Println("exec:", strings.Join(argv, " "))
 
-	// build args
-	for _, key := range r.state.docker.buildArg.Keys() {
-		val := rg.Must(r.state.docker.buildArg.Get(key))
-		if !val.IsString() {
-			continue
-		}
-		valStr := rg.Must(val.ToString())
-		args = append(args, "--build-arg", key+"="+valStr)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = r.state.workdir
+	// later values take precedence
+	cmd.Env = append(rg.Must(r.createEnviron()), env...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
 	}
 
-	// images
-	for _, image := range r.state.docker.images {
-		args = append(args, "-t", image)
-	}
+	return rg.Must(fastjs.Object(r, rg.Must(r.runCommandForResult(cmd, opts)))).Value()
+}
 
-	// dockerfile
-	if r.state.docker.dockerfilePath != "" {
-		args = append(args, "-f", r.state.docker.dockerfilePath)
+func (r *Runner) runDockerBuild(call otto.FunctionCall) otto.Value {
+	if len(r.state.docker.images) == 0 {
+		rg.Must0(errors.New("no images to build"))
+		return otto.UndefinedValue()
 	}
 
-	// build context
-	if r.state.docker.buildContext != "" {
-		args = append(args, r.state.docker.buildContext)
-	} else {
-		args = append(args, ".")
+	var skipIfExists bool
+	if arg := call.Argument(0); arg.IsObject() && arg.Class() == "Object" {
+		rg.Must0(fastjs.LoadBoolField(&skipIfExists, arg.Object(), "skipIfExists"))
 	}
 
-	log.Println("run docker build:", strings.Join(args, " "))
+	// reuse the image of the same fingerprint
+	r.state.docker.fingerprint = ""
+	if skipIfExists {
+		fingerprint := rg.Must(r.computeDockerFingerprint())
+		log.Println("docker build fingerprint:", fingerprint)
 
-	cmd := exec.Command("docker", args...)
-	cmd.Env = rg.Must(r.createEnviron())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	rg.Must0(cmd.Run())
+		c := rg.Must(r.createRegistryClient())
+		if rg.Must(r.findDockerFingerprintImage(c, fingerprint)) {
+			return rg.Must(r.createDockerDigestArray(rg.Must(r.reuseDockerFingerprintImage(c, fingerprint)))).Value()
+		}
+		r.state.docker.fingerprint = fingerprint
+	}
 
-	return rg.Must(fastjs.Array(r, r.state.docker.images)).Value()
+	name, backend := rg.Must2(r.resolveDockerBackend())
+	log.Println("run docker build with backend:", name)
+
+	out := rg.Must(backend.build(r))
+
+	var results []*dockerImageDigest
+	images := r.resolveDockerImages()
+	r.state.docker.digests = map[string]*dockerImageDigest{}
+	for _, image := range images {
+		d := &dockerImageDigest{
+			image:    image,
+			digest:   out.digest,
+			platform: strings.Join(r.state.docker.platforms, ","),
+			size:     out.size,
+			pushed:   out.pushed,
+		}
+		r.state.docker.digests[image] = d
+		results = append(results, d)
+	}
+	if out.pushed {
+		log.Println("docker images pushed:", strings.Join(images, ", "), "digest:", out.digest)
+		rg.Must0(r.tagDockerFingerprint())
+	}
+
+	return rg.Must(r.createDockerDigestArray(results)).Value()
 }
 
 func (r *Runner) runDockerPush(call otto.FunctionCall) otto.Value {
@@ -194,26 +374,86 @@ func (r *Runner) runDockerPush(call otto.FunctionCall) otto.Value {
 		rg.Must0(errors.New("no images to push"))
 		return otto.UndefinedValue()
 	}
-	for _, image := range r.state.docker.images {
-		var args []string
+	if r.state.docker.digests == nil {
+		r.state.docker.digests = map[string]*dockerImageDigest{}
+	}
+
+	opts := rg.Must(loadDockerPushOptions(call.Argument(0)))
+
+	name, backend := rg.Must2(r.resolveDockerBackend())
+
+	// prepare on the main goroutine, otto is not goroutine safe
+	// images are fanned out to mirrors of useDockerRegistries()
+	images := r.resolveDockerImages()
+	results := make([]*dockerPushResult, len(images))
+	runs := make([]dockerPushFunc, len(images))
+	for i, image := range images {
+		// already pushed by runDockerBuild
+		if d := r.state.docker.digests[image]; d != nil && d.pushed {
+			log.Println("skip docker push, already pushed:", image)
+			results[i] = &dockerPushResult{dockerImageDigest: d, status: dockerPushStatusSkipped}
+			continue
+		}
 
-		// config
-		if r.state.docker.configPath != "" {
-			args = append(args, "--config", r.state.docker.configPath)
+		d := &dockerImageDigest{image: image, pushed: true}
+		if built := r.state.docker.digests[image]; built != nil {
+			d.platform = built.platform
 		}
+		results[i] = &dockerPushResult{dockerImageDigest: d}
+		runs[i] = rg.Must(backend.push(r, image))
+	}
 
-		// command
-		args = append(args, "push", image)
+	log.Println("run docker push with backend:", name, "concurrency:", opts.concurrency, "retries:", opts.retries)
 
-		log.Println("run docker push:", strings.Join(args, " "))
+	// images are pushed in order by a pool of workers
+	jobs := make(chan int, len(runs))
+	for i, run := range runs {
+		if run != nil {
+			jobs <- i
+		}
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for range min(opts.concurrency, len(runs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := results[i]
+				res.digest, res.size, res.attempts, res.err = r.retryDockerPush(res.image, runs[i], opts.retries)
+			}
+		}()
+	}
+	wg.Wait()
 
-		cmd := exec.Command("docker", args...)
-		cmd.Env = rg.Must(r.createEnviron())
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		rg.Must0(cmd.Run())
+	var errs []error
+	for _, res := range results {
+		if res.status == dockerPushStatusSkipped {
+			continue
+		}
+		if res.err != nil {
+			res.status, res.pushed = dockerPushStatusFailed, false
+			log.Println("docker push failed:", res.image, "attempts:", res.attempts, "error:", res.err)
+			errs = append(errs, fmt.Errorf("failed to push %s after %d attempts: %w", res.image, res.attempts, res.err))
+			continue
+		}
+		res.status = dockerPushStatusPushed
+		if res.digest != "" {
+			log.Println("docker image pushed:", res.image, "digest:", res.digest)
+		}
+		r.state.docker.digests[res.image] = res.dockerImageDigest
 	}
-	return rg.Must(fastjs.Array(r, r.state.docker.images)).Value()
+
+	if len(errs) > 0 {
+		if !opts.allowFailure {
+			rg.Must0(errors.Join(errs...))
+		}
+	} else {
+		rg.Must0(r.tagDockerFingerprint())
+	}
+
+	return rg.Must(r.createDockerPushArray(results)).Value()
 }
 
 func (r *Runner) useKubernetesWorkload(call otto.FunctionCall) otto.Value {
@@ -224,6 +464,9 @@ func (r *Runner) useKubernetesWorkload(call otto.FunctionCall) otto.Value {
 		rg.Must0(fastjs.LoadStringField(&r.state.kubernetes.workload.kind, obj, "kind"))
 		rg.Must0(fastjs.LoadStringField(&r.state.kubernetes.workload.container, obj, "container"))
 		rg.Must0(fastjs.LoadBoolField(&r.state.kubernetes.workload.init, obj, "init"))
+		rg.Must0(fastjs.LoadBoolField(&r.state.kubernetes.workload.wait, obj, "wait"))
+		rg.Must0(fastjs.LoadDurationField(&r.state.kubernetes.workload.timeout, obj, "timeout"))
+		rg.Must0(fastjs.LoadBoolField(&r.state.kubernetes.workload.digest, obj, "digest"))
 	}
 	return rg.Must(fastjs.Object(r, map[string]any{
 		"namespace": r.state.kubernetes.workload.namespace,
@@ -231,25 +474,19 @@ func (r *Runner) useKubernetesWorkload(call otto.FunctionCall) otto.Value {
 		"kind":      r.state.kubernetes.workload.kind,
 		"container": r.state.kubernetes.workload.container,
 		"init":      r.state.kubernetes.workload.init,
+		"wait":      r.state.kubernetes.workload.wait,
+		"timeout":   r.state.kubernetes.workload.timeout.String(),
+		"digest":    r.state.kubernetes.workload.digest,
 	})).Value()
 }
 
-func (r *Runner) resolveCodingCredentials() (username string, password string) {
-	var parts []string
-	if r.state.coding.values.team != "" {
-		parts = append(parts, cleanEnvKey(r.state.coding.values.team))
-		if r.state.coding.values.project != "" {
-			parts = append(parts, cleanEnvKey(r.state.coding.values.project))
-			if r.state.coding.values.repo != "" {
-				parts = append(parts, cleanEnvKey(r.state.coding.values.repo))
-			}
-		}
-	}
-	usernameKeys := []string{"CODING_USERNAME"}
-	passwordKeys := []string{"CODING_PASSWORD"}
+// resolveCredentials searches environment, most specific key first
+func (r *Runner) resolveCredentials(prefix string, parts []string, name string) (username string, password string) {
+	usernameKeys := []string{prefix + "_USERNAME"}
+	passwordKeys := []string{prefix + "_PASSWORD"}
 	for i := range parts {
-		usernameKeys = append(usernameKeys, "CODING_"+strings.Join(parts[:i+1], "_")+"_USERNAME")
-		passwordKeys = append(passwordKeys, "CODING_"+strings.Join(parts[:i+1], "_")+"_PASSWORD")
+		usernameKeys = append(usernameKeys, prefix+"_"+strings.Join(parts[:i+1], "_")+"_USERNAME")
+		passwordKeys = append(passwordKeys, prefix+"_"+strings.Join(parts[:i+1], "_")+"_PASSWORD")
 	}
 	slices.Reverse(usernameKeys)
 	slices.Reverse(passwordKeys)
@@ -258,7 +495,7 @@ func (r *Runner) resolveCodingCredentials() (username string, password string) {
 		val := rg.Must(r.env.Get(usernameKey))
 		if val.IsString() {
 			username = val.String()
-			log.Println("use coding username from:", usernameKey)
+			log.Println("use", name, "username from:", usernameKey)
 			break
 		}
 	}
@@ -267,39 +504,185 @@ func (r *Runner) resolveCodingCredentials() (username string, password string) {
 		val := rg.Must(r.env.Get(passwordKey))
 		if val.IsString() {
 			password = val.String()
-			log.Println("use coding password from:", passwordKey)
+			log.Println("use", name, "password from:", passwordKey)
 			break
 		}
 	}
 	return
 }
 
+func (r *Runner) resolveCodingCredentials() (username string, password string) {
+	var parts []string
+	if r.state.coding.values.team != "" {
+		parts = append(parts, cleanEnvKey(r.state.coding.values.team))
+		if r.state.coding.values.project != "" {
+			parts = append(parts, cleanEnvKey(r.state.coding.values.project))
+			if r.state.coding.values.repo != "" {
+				parts = append(parts, cleanEnvKey(r.state.coding.values.repo))
+			}
+		}
+	}
+	return r.resolveCredentials("CODING", parts, "coding")
+}
+
 func (r *Runner) useCodingValues(call otto.FunctionCall) otto.Value {
 	if arg := call.Argument(0); arg.IsObject() {
 		obj := arg.Object()
+		rg.Must0(fastjs.LoadStringField(&r.state.coding.values.baseURL, obj, "baseURL"))
 		rg.Must0(fastjs.LoadStringField(&r.state.coding.values.team, obj, "team"))
 		rg.Must0(fastjs.LoadStringField(&r.state.coding.values.project, obj, "project"))
 		rg.Must0(fastjs.LoadStringField(&r.state.coding.values.repo, obj, "repo"))
 		rg.Must0(fastjs.LoadStringField(&r.state.coding.values.branch, obj, "branch"))
 		rg.Must0(fastjs.LoadStringField(&r.state.coding.values.file, obj, "file"))
 		rg.Must0(fastjs.LoadFunctionField(&r.state.coding.values.update, obj, "update"))
+		rg.Must0(loadGitMergeRequestOptions(&r.state.coding.values.mergeRequest, obj))
 	}
 	return rg.Must(fastjs.Object(r, map[string]any{
+		"baseURL": r.state.coding.values.baseURL,
 		"team":    r.state.coding.values.team,
 		"project": r.state.coding.values.project,
 		"repo":    r.state.coding.values.repo,
 		"branch":  r.state.coding.values.branch,
 		"file":    r.state.coding.values.file,
 		"update":  r.state.coding.values.update,
+
+		"mergeRequest": r.state.coding.values.mergeRequest.enabled,
+		"autoMerge":    r.state.coding.values.mergeRequest.autoMerge,
+		"apiURL":       r.state.coding.values.mergeRequest.apiURL,
+	})).Value()
+}
+
+func (r *Runner) resolveGitCredentials() (username string, password string) {
+	if r.state.git.values.username != "" || r.state.git.values.password != "" {
+		return r.state.git.values.username, r.state.git.values.password
+	}
+	host, repoPath := parseGitRemote(r.state.git.values.url)
+
+	var parts []string
+	if host != "" {
+		parts = append(parts, cleanEnvKey(host))
+	}
+	for _, part := range strings.Split(strings.TrimSuffix(repoPath, ".git"), "/") {
+		if part != "" {
+			parts = append(parts, cleanEnvKey(part))
+		}
+	}
+	return r.resolveCredentials("GIT", parts, "git")
+}
+
+func (r *Runner) useGitValues(call otto.FunctionCall) otto.Value {
+	if arg := call.Argument(0); arg.IsObject() {
+		obj := arg.Object()
+		rg.Must0(fastjs.LoadStringField(&r.state.git.values.url, obj, "url"))
+		rg.Must0(fastjs.LoadStringField(&r.state.git.values.branch, obj, "branch"))
+		rg.Must0(fastjs.LoadStringField(&r.state.git.values.file, obj, "file"))
+		rg.Must0(fastjs.LoadFunctionField(&r.state.git.values.update, obj, "update"))
+		rg.Must0(loadGitMergeRequestOptions(&r.state.git.values.mergeRequest, obj))
+		if credentials := rg.Must(obj.Get("credentials")); credentials.IsObject() {
+			rg.Must0(fastjs.LoadStringField(&r.state.git.values.username, credentials.Object(), "username"))
+			rg.Must0(fastjs.LoadStringField(&r.state.git.values.password, credentials.Object(), "password"))
+		} else if credentials.IsNull() {
+			r.state.git.values.username, r.state.git.values.password = "", ""
+		}
+	}
+	return rg.Must(fastjs.Object(r, map[string]any{
+		"url":    r.state.git.values.url,
+		"branch": r.state.git.values.branch,
+		"file":   r.state.git.values.file,
+		"update": r.state.git.values.update,
+
+		"mergeRequest": r.state.git.values.mergeRequest.enabled,
+		"autoMerge":    r.state.git.values.mergeRequest.autoMerge,
+		"forge":        r.state.git.values.mergeRequest.forge,
+		"apiURL":       r.state.git.values.mergeRequest.apiURL,
 	})).Value()
 }
 
 func (r *Runner) deployKubernetesWorkload(call otto.FunctionCall) otto.Value {
-	return otto.NullValue()
+	if len(r.state.docker.images) == 0 {
+		rg.Must0(errors.New("no images to deploy"))
+		return otto.UndefinedValue()
+	}
+	image := r.state.docker.images[0]
+	if r.state.kubernetes.workload.digest {
+		image = rg.Must(r.resolveDockerImageReference(image))
+	}
+
+	target := rg.Must(r.createKubernetesWorkloadTarget())
+	rg.Must0(target.patchImage(r.ctx, image))
+
+	if r.state.kubernetes.workload.wait {
+		rg.Must0(target.waitRollout(r.ctx, image, r.state.kubernetes.workload.timeout))
+	}
+
+	return rg.Must(otto.ToValue(image))
 }
 
 func (r *Runner) deployCodingValues(call otto.FunctionCall) otto.Value {
-	return otto.NullValue()
+	if r.state.coding.values.team == "" || r.state.coding.values.project == "" || r.state.coding.values.repo == "" {
+		rg.Must0(errors.New("coding team, project and repo are required, use useCodingValues() first"))
+		return otto.UndefinedValue()
+	}
+
+	baseURL := r.state.coding.values.baseURL
+	if baseURL == "" {
+		baseURL = codingBaseURLDefault
+	}
+
+	repoPath := strings.Join([]string{
+		r.state.coding.values.team,
+		r.state.coding.values.project,
+		r.state.coding.values.repo,
+	}, "/")
+
+	target := gitValuesTarget{
+		url:          strings.TrimSuffix(baseURL, "/") + "/" + repoPath + ".git",
+		branch:       r.state.coding.values.branch,
+		file:         r.state.coding.values.file,
+		update:       r.state.coding.values.update,
+		mergeRequest: r.state.coding.values.mergeRequest,
+		forgeRepo:    repoPath,
+	}
+	target.username, target.password = r.resolveCodingCredentials()
+
+	target.mergeRequest.forge = fastforge.KindCoding
+	if target.mergeRequest.apiURL == "" {
+		target.mergeRequest.apiURL = strings.TrimSuffix(baseURL, "/") + "/open-api"
+	}
+
+	return rg.Must(r.patchGitValues(target)).value()
+}
+
+func (r *Runner) deployGitValues(call otto.FunctionCall) otto.Value {
+	if r.state.git.values.url == "" {
+		rg.Must0(errors.New("git url is required, use useGitValues() first"))
+		return otto.UndefinedValue()
+	}
+
+	host, repoPath := parseGitRemote(r.state.git.values.url)
+
+	target := gitValuesTarget{
+		url:          r.state.git.values.url,
+		branch:       r.state.git.values.branch,
+		file:         r.state.git.values.file,
+		update:       r.state.git.values.update,
+		mergeRequest: r.state.git.values.mergeRequest,
+		forgeRepo:    strings.TrimSuffix(repoPath, ".git"),
+	}
+	target.username, target.password = r.resolveGitCredentials()
+
+	if target.mergeRequest.enabled {
+		if target.mergeRequest.forge == "" {
+			if target.mergeRequest.forge = fastforge.DetectKind(host); target.mergeRequest.forge == "" {
+				rg.Must0(errors.New("cannot detect forge from git url, set 'forge' in useGitValues()"))
+			}
+		}
+		if target.mergeRequest.apiURL == "" {
+			target.mergeRequest.apiURL = fastforge.DefaultAPIURL(target.mergeRequest.forge, host)
+		}
+	}
+
+	return rg.Must(r.patchGitValues(target)).value()
 }
 
 func (r *Runner) setup() (err error) {
@@ -313,41 +696,54 @@ func (r *Runner) setup() (err error) {
 		return
 	}
 
-	r.vm.Set("useShell", fastjs.GetterSetterForStringSlice(r, &r.state.shell, "shell"))
-	r.vm.Set("useEnv", fastjs.GetterSetterForObject(r, r.env, "env"))
-	r.vm.Set("useDockerConfig", fastjs.GetterSetterForLongString(r, &r.state.docker.configPath, "docker config", func(buf []byte, name string) (out string, err error) {
-		_, out, err = r.createTempFile("config.json", bytes.TrimSpace(buf))
-		return
-	}))
-	r.vm.Set("useKubeconfig", fastjs.GetterSetterForLongString(r, &r.state.kubernetes.kubeconfigPath, "kubeconfig", func(buf []byte, name string) (out string, err error) {
+	r.setFunction("useTimeout", r.useTimeout)
+	r.setFunction("useWorkdir", r.useWorkdir)
+	r.setFunction("useShell", fastjs.GetterSetterForStringSlice(r, &r.state.shell, "shell"))
+	r.setFunction("useEnv", fastjs.GetterSetterForObject(r, r.env, "env"))
+	r.setFunction("useDockerConfig", r.useDockerConfig)
+	r.setFunction("useKubeconfig", fastjs.GetterSetterForLongString(r, &r.state.kubernetes.kubeconfigPath, "kubeconfig", func(buf []byte, name string) (out string, err error) {
 		buf = rg.Must(toYaml(bytes.TrimSpace(buf)))
 		out, _, err = r.createTempFile("kubeconfig.yaml", buf)
 		return
 	}))
 
-	r.vm.Set("useScript", fastjs.GetterSetterForLongString(r, &r.state.script.path, "script", func(buf []byte, name string) (out string, err error) {
-		out, _, err = r.createTempFile("script.sh", bytes.TrimSpace(buf))
-		return
-	}))
-	r.vm.Set("runScript", r.runScript)
+	r.setFunction("useScript", r.useScript)
+	r.setStep("runScript", r.runScript)
+	r.setStep("exec", r.exec)
 
-	r.vm.Set("useDockerImages", fastjs.GetterSetterForStringSlice(r, &r.state.docker.images, "docker images"))
-	r.vm.Set("useDockerBuildArg", fastjs.GetterSetterForObject(r, r.state.docker.buildArg, "docker build arg"))
-	r.vm.Set("useDockerfile", fastjs.GetterSetterForLongString(r, &r.state.docker.dockerfilePath, "dockerfile", func(buf []byte, name string) (out string, err error) {
+	r.setFunction("useDockerImages", fastjs.GetterSetterForStringSlice(r, &r.state.docker.images, "docker images"))
+	r.setFunction("useDockerRegistries", r.useDockerRegistries)
+	r.setFunction("useDockerBuildArg", fastjs.GetterSetterForObject(r, r.state.docker.buildArg, "docker build arg"))
+	r.setFunction("useDockerfile", fastjs.GetterSetterForLongString(r, &r.state.docker.dockerfilePath, "dockerfile", func(buf []byte, name string) (out string, err error) {
 		out, _, err = r.createTempFile("Dockerfile", bytes.TrimSpace(buf))
 		return
 	}))
-	r.vm.Set("useDockerBuildContext", fastjs.GetterSetterForString(r, &r.state.docker.buildContext, "docker context"))
-	r.vm.Set("runDockerBuild", r.runDockerBuild)
-	r.vm.Set("runDockerPush", r.runDockerPush)
-
-	r.vm.Set("useKubernetesWorkload", r.useKubernetesWorkload)
-	r.vm.Set("deployKubernetesWorkload", r.deployKubernetesWorkload)
-
-	r.vm.Set("useCodingValues", r.useCodingValues)
-	r.vm.Set("deployCodingValues", r.deployCodingValues)
-
-	r.vm.Set("useDeployer", r.useDeployer)
+	r.setFunction("useDockerPlatforms", fastjs.GetterSetterForStringSlice(r, &r.state.docker.platforms, "docker platforms"))
+	r.setFunction("useDockerCache", r.useDockerCache)
+	r.setFunction("useDockerBuildSecret", r.useDockerBuildSecret)
+	r.setFunction("useDockerBuildSSH", r.useDockerBuildSSH)
+	r.setFunction("useDockerBuildOptions", r.useDockerBuildOptions)
+	r.setFunction("useDockerBuildContext", fastjs.GetterSetterForString(r, &r.state.docker.buildContext, "docker context"))
+	r.setFunction("useDockerBackend", r.useDockerBackend)
+	r.setStep("runDockerBuild", r.runDockerBuild)
+	r.setStep("runDockerPush", r.runDockerPush)
+	r.setStep("copyImage", r.copyImage)
+	r.setStep("tagImage", r.tagImage)
+	r.setStep("inspectImage", r.inspectImage)
+	r.setFunction("useDockerDigest", r.useDockerDigest)
+
+	r.setFunction("useKubernetesWorkload", r.useKubernetesWorkload)
+	r.setStep("deployKubernetesWorkload", r.deployKubernetesWorkload)
+
+	r.setFunction("useCodingValues", r.useCodingValues)
+	r.setStep("deployCodingValues", r.deployCodingValues)
+
+	r.setFunction("useGitValues", r.useGitValues)
+	r.setStep("deployGitValues", r.deployGitValues)
+
+	r.setStep("editYamlFile", r.editYamlFile)
+
+	r.setFunction("useDeployer", r.useDeployer)
 	return
 }
 
@@ -362,6 +758,7 @@ func (r *Runner) clean() {
 	r.tempDirs = nil
 	r.env = nil
 	r.state.coding.values.update = otto.Value{} // reset to undefined
+	r.state.git.values.update = otto.Value{}
 	r.vm = nil
 }
 
@@ -386,12 +783,166 @@ func (r *Runner) createTempFile(filename string, content []byte) (file string, d
 	return
 }
 
+// createSecretFile creates a temporary file only accessible by the current user
+func (r *Runner) createSecretFile(filename string, content []byte) (file string, err error) {
+	defer rg.Guard(&err)
+	dir := rg.Must(r.createTempDir())
+	rg.Must0(os.Chmod(dir, 0700))
+	file = filepath.Join(dir, filename)
+	rg.Must0(os.WriteFile(file, content, 0600))
+	return
+}
+
+// createStep records the running step, with timeout and cwd options
+func (r *Runner) createStep(name string, fn func(call otto.FunctionCall) otto.Value) func(call otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		var (
+			timeout time.Duration
+			cwd     string
+		)
+		for _, arg := range call.ArgumentList {
+			if arg.IsObject() && arg.Class() == "Object" {
+				rg.Must0(fastjs.LoadDurationField(&timeout, arg.Object(), "timeout"))
+				rg.Must0(fastjs.LoadStringField(&cwd, arg.Object(), "cwd"))
+				break
+			}
+		}
+
+		prevStep, prevCtx, prevWorkdir := r.step, r.ctx, r.state.workdir
+		defer func() {
+			r.ctx = prevCtx
+			r.state.workdir = prevWorkdir
+		}()
+
+		r.step = name
+
+		if cwd != "" {
+			r.state.workdir = rg.Must(r.resolveWorkdir(cwd))
+		}
+
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(prevCtx, timeout)
+			defer cancel()
+			r.ctx = ctx
+
+			start := time.Now()
+			defer func() {
+				// only the timeout of this step is catchable
+				if ctx.Err() == nil || prevCtx.Err() != nil {
+					return
+				}
+				if recover() == nil {
+					return
+				}
+				r.step = prevStep
+				panic(r.vm.MakeCustomError("TimeoutError", fmt.Sprintf("%s timed out after %s", name, time.Since(start).Round(time.Millisecond))))
+			}()
+		}
+
+		ret := fn(call)
+		// not deferred, the step name is kept if fn panics
+		r.step = prevStep
+		return ret
+	}
+}
+
+func (r *Runner) useTimeout(call otto.FunctionCall) otto.Value {
+	if arg := call.Argument(0); arg.IsNull() {
+		r.setTimeout(0)
+	} else if !arg.IsUndefined() {
+		r.setTimeout(rg.Must(fastjs.ToDuration(arg)))
+	}
+	if r.state.timeout == 0 {
+		return otto.NullValue()
+	}
+	return rg.Must(otto.ToValue(r.state.timeout.String()))
+}
+
+// setTimeout sets the pipeline timeout, zero to disable
+func (r *Runner) setTimeout(timeout time.Duration) {
+	if r.timeoutTimer != nil {
+		r.timeoutTimer.Stop()
+		r.timeoutTimer = nil
+	}
+	r.state.timeout = timeout
+
+	if timeout == 0 {
+		log.Println("use timeout: none")
+		return
+	}
+
+	log.Println("use timeout:", timeout.String())
+
+	cancel := r.cancel
+	r.timeoutTimer = time.AfterFunc(time.Until(r.started.Add(timeout)), func() {
+		cancel(context.DeadlineExceeded)
+	})
+}
+
+// watchContext interrupts the vm when the context is done, until stop is closed
+func (r *Runner) watchContext(ctx context.Context, stop chan struct{}) {
+	vm := r.vm
+	vm.Interrupt = make(chan func(), 1)
+
+	go func() {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+		}
+
+		var interrupt func()
+		interrupt = func() {
+			// re-arm the interrupt, in case the panic is caught by try-catch of the script
+			vm.Interrupt <- interrupt
+			panic(context.Cause(ctx))
+		}
+		vm.Interrupt <- interrupt
+	}()
+}
+
 func (r *Runner) Execute(ctx context.Context, script any) (err error) {
+	ctx, r.cancel = context.WithCancelCause(ctx)
+	defer r.cancel(nil)
+
+	defer func() {
+		if r.timeoutTimer != nil {
+			r.timeoutTimer.Stop()
+			r.timeoutTimer = nil
+		}
+	}()
+
+	r.ctx = ctx
+	r.step = ""
+	r.started = time.Now()
+
+	defer func() {
+		if cause := context.Cause(ctx); cause != nil && err != nil {
+			if !errors.Is(err, cause) {
+				err = cause
+			}
+			step := r.step
+			if step == "" {
+				step = "script"
+			}
+			err = fmt.Errorf("%s interrupted after %s: %w", step, time.Since(r.started).Round(time.Millisecond), err)
+		}
+	}()
+
 	defer rg.Guard(&err)
 
 	rg.Must0(r.setup())
 	defer r.clean()
 
-	_, err = r.vm.Run(script)
+	stop := make(chan struct{})
+	defer close(stop)
+	r.watchContext(ctx, stop)
+
+	if _, err = r.vm.Run(script); err != nil {
+		var oe *otto.Error
+		if errors.As(err, &oe) {
+			err = &ScriptError{err: oe}
+		}
+	}
 	return
 }
@@ -0,0 +1,127 @@
+package fastci
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	"github.com/yankeguo/fastci/pkg/fastjs"
+	"github.com/yankeguo/rg"
+)
+
+const (
+	containerWorkdirDefault = "/workspace"
+	containerHomeDefault    = "/tmp"
+)
+
+var (
+	// containerEnvExcludes are host specific environment variables
+	containerEnvExcludes = []string{
+		"PATH", "HOME", "HOSTNAME", "PWD", "OLDPWD", "SHLVL", "SHELL",
+		"USER", "LOGNAME", "TMPDIR", "TERM", "_",
+	}
+)
+
+// containerOptions are the container options of runScript
+type containerOptions struct {
+	image   string
+	volumes []string
+	workdir string
+	user    string
+}
+
+func loadContainerOptions(out *containerOptions, obj *otto.Object) (err error) {
+	if err = fastjs.LoadStringField(&out.image, obj, "image"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringSliceField(&out.volumes, obj, "volumes"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringField(&out.workdir, obj, "workdir"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringField(&out.user, obj, "user"); err != nil {
+		return
+	}
+	return
+}
+
+// createContainerCommand creates a "docker run" command
+func (r *Runner) createContainerCommand(opts containerOptions, shell []string, env []string) (cmd *exec.Cmd, name string, err error) {
+	defer rg.Guard(&err)
+
+	// config
+	args := dockerCLIBackend{}.configArgs(r)
+
+	// command, with an init process forwarding signals, and a name for removal
+	buf := make([]byte, 6)
+	rg.Must(rand.Read(buf))
+	name = "fastci-" + hex.EncodeToString(buf)
+	args = append(args, "run", "--rm", "-i", "--init", "--name", name)
+
+	// working directory
+	workdir := opts.workdir
+	if workdir == "" {
+		workdir = containerWorkdirDefault
+	}
+	args = append(args, "-v", rg.Must(r.currentWorkdir())+":"+workdir, "-w", workdir)
+
+	// volumes
+	for _, volume := range opts.volumes {
+		args = append(args, "-v", volume)
+	}
+
+	// user, the current user by default
+	if opts.user != "" {
+		args = append(args, "-u", opts.user)
+	} else if uid := os.Getuid(); uid >= 0 {
+		args = append(args, "-u", strconv.Itoa(uid)+":"+strconv.Itoa(os.Getgid()), "-e", "HOME="+containerHomeDefault)
+	}
+
+	// environment variables, passed by name
+	var keys []string
+	for _, item := range env {
+		key, _, _ := strings.Cut(item, "=")
+		if slices.Contains(containerEnvExcludes, key) || slices.Contains(keys, key) {
+			continue
+		}
+		keys = append(keys, key)
+		args = append(args, "-e", key)
+	}
+
+	// image and shell
+	args = append(args, opts.image)
+	args = append(args, shell...)
+
+	log.Println("run script in container:", strings.Join(args, " "))
+
+	cmd = exec.Command("docker", args...)
+	cmd.Env = env
+	return
+}
+
+// removeCancelledContainer removes the container of a cancelled step
+func (r *Runner) removeCancelledContainer(name string, env []string) {
+	if r.ctx.Err() == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), processGracePeriod)
+	defer cancel()
+
+	args := append(dockerCLIBackend{}.configArgs(r), "rm", "-f", name)
+	log.Println("remove container:", name)
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Env = env
+	if buf, err := cmd.CombinedOutput(); err != nil {
+		log.Println("failed to remove container:", name, "error:", err, strings.TrimSpace(string(buf)))
+	}
+}
@@ -0,0 +1,137 @@
+package fastci
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const fakeDockerPushDigest = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// fakeDockerForTest puts fake container binaries on PATH, which record their calls
+func fakeDockerForTest(t *testing.T) (dir string) {
+	dir = t.TempDir()
+	script := []byte(`#!/bin/sh
+printf '%s\n' "$@" > "` + dir + `/args"
+echo "${0##*/} $*" >> "` + dir + `/calls"
+cat > "` + dir + `/stdin"
+printf '%s' "$SECRET" > "` + dir + `/secret"
+pwd > "` + dir + `/pwd"
+prev=""
+for arg in "$@"; do
+	if [ "$prev" = "--metadata-file" ]; then
+		printf '{"containerimage.digest":"sha256:fake","containerimage.descriptor":{"size":1024}}' > "$arg"
+	fi
+	if [ "$prev" = "--digestfile" ] || [ "$prev" = "--digest-file" ]; then
+		printf 'sha256:` + fakeDockerPushDigest + `\n' > "$arg"
+	fi
+	prev="$arg"
+done
+if [ "$1" = "push" ]; then
+	echo "latest: digest: sha256:` + fakeDockerPushDigest + ` size: 2048"
+fi
+`)
+	for _, name := range []string{"docker", "podman", "buildah", "executor"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), script, 0755))
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return
+}
+
+func TestRunnerRunScriptInContainer(t *testing.T) {
+	dir := fakeDockerForTest(t)
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	r := runnerForTest(t, `
+	useDockerConfig({content: {auths: {}}})
+	useEnv('SECRET', 'hush')
+	useScript('go build ./...')
+	runScript({
+		image: 'golang:1.23',
+		volumes: ['/tmp/cache:/go/pkg/mod'],
+		workdir: '/src',
+	})
+	`)
+	defer clearRunnerForTest(t, r)
+
+	args := fakeDockerArgsForTest(t, dir)
+
+	require.Equal(t, []string{
+		"--config", r.state.docker.configPath,
+		"run", "--rm", "-i", "--init", "--name", args[7],
+		"-v", cwd + ":/src", "-w", "/src",
+		"-v", "/tmp/cache:/go/pkg/mod",
+		"-u", strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid()), "-e", "HOME=/tmp",
+	}, args[:18])
+	require.Regexp(t, `^fastci-[0-9a-f]{12}$`, args[7])
+	require.Equal(t, []string{"golang:1.23", "sh"}, args[len(args)-2:])
+
+	// environment variables are passed by name, except the host specific ones
+	require.Contains(t, args, "SECRET")
+	require.NotContains(t, args, "PATH")
+	require.NotContains(t, args, "hush")
+
+	buf, err := os.ReadFile(filepath.Join(dir, "secret"))
+	require.NoError(t, err)
+	require.Equal(t, "hush", string(buf))
+
+	buf, err = os.ReadFile(filepath.Join(dir, "stdin"))
+	require.NoError(t, err)
+	require.Equal(t, "go build ./...", string(buf))
+}
+
+func TestRunnerRunScriptInContainerUser(t *testing.T) {
+	dir := fakeDockerForTest(t)
+
+	r := runnerForTest(t, `
+	useShell('bash', '-eu')
+	useScript('test', ['make test'])
+	runScript('test', {image: 'node:20', user: 'root'})
+	`)
+	defer clearRunnerForTest(t, r)
+
+	args := fakeDockerArgsForTest(t, dir)
+
+	require.Equal(t, []string{"-u", "root"}, args[10:12])
+	require.NotContains(t, args, "HOME=/tmp")
+	require.Equal(t, []string{"node:20", "bash", "-eu"}, args[len(args)-3:])
+}
+
+func TestRunnerRunScriptInContainerCancelled(t *testing.T) {
+	fakeDockerForTest(t)
+
+	// docker run blocks until terminated
+	dir := t.TempDir()
+	script := []byte(`#!/bin/sh
+echo "$*" >> "` + dir + `/calls"
+if [ "$1" = "run" ]; then
+	sleep 5
+fi
+`)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker"), script, 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	r := runnerForTest(t, `
+	useScript('sleep 60')
+	try {
+		runScript({image: 'alpine:3', timeout: '300ms'})
+	} catch (e) {
+		if (e.name !== 'TimeoutError') {
+			throw e
+		}
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+
+	// the container is removed by name, since killing "docker run" leaves it running
+	calls := fakeDockerCallsForTest(t, dir)
+	require.Len(t, calls, 2)
+	name := strings.Fields(calls[0])[5]
+	require.True(t, strings.HasPrefix(calls[0], "run --rm -i --init --name "+name+" "))
+	require.Equal(t, "rm -f "+name, calls[1])
+}
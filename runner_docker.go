@@ -0,0 +1,676 @@
+package fastci
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	"github.com/yankeguo/fastci/pkg/fastjs"
+	"github.com/yankeguo/rg"
+)
+
+const (
+	// dockerPushOutputTailSize is the tail of "docker push" output kept
+	dockerPushOutputTailSize = 4 * 1024
+
+	dockerPushConcurrencyDefault = 4
+	dockerPushRetriesDefault     = 3
+	// dockerPushRetryMaxDelay caps the exponential backoff between attempts
+	dockerPushRetryMaxDelay = 30 * time.Second
+
+	dockerPushStatusPushed  = "pushed"
+	dockerPushStatusSkipped = "skipped"
+	dockerPushStatusFailed  = "failed"
+)
+
+var (
+	// dockerPushDigest matches "latest: digest: sha256:... size: 1234"
+	dockerPushDigest = regexp.MustCompile(`digest: (sha256:[0-9a-f]{64}) size: (\d+)`)
+
+	// dockerPushRetryable matches transient failures
+	dockerPushRetryable = regexp.MustCompile(`(?i)(status(?: code)?:? (?:5\d\d|429)\b|too ?many ?requests|internal server error|bad gateway|service unavailable|gateway time-?out|connection (?:reset|refused)|i/o timeout|tls handshake timeout|\bEOF\b|no such host|server misbehaving|broken pipe)`)
+
+	// dockerBuildxDriver matches "Driver: docker-container" of "docker buildx inspect"
+	dockerBuildxDriver = regexp.MustCompile(`(?m)^Driver:\s*(\S+)`)
+
+	// dockerPushRetryDelay is the delay before the first retry
+	dockerPushRetryDelay = time.Second
+)
+
+// dockerImageDigest is the digest of an image built or pushed
+type dockerImageDigest struct {
+	image    string
+	digest   string
+	platform string
+	size     int64
+	// pushed is true if the digest is known by the registry
+	pushed bool
+}
+
+// reference returns "repo@sha256:...", empty if not pushed
+func (d *dockerImageDigest) reference() string {
+	if d == nil || !d.pushed || d.digest == "" {
+		return ""
+	}
+	return dockerImageRepository(d.image) + "@" + d.digest
+}
+
+func (d *dockerImageDigest) object() map[string]any {
+	return map[string]any{
+		"image":     d.image,
+		"digest":    d.digest,
+		"platform":  d.platform,
+		"size":      d.size,
+		"reference": d.reference(),
+	}
+}
+
+// createDockerDigestArray converts digests for JavaScript
+func (r *Runner) createDockerDigestArray(ds []*dockerImageDigest) (arr *otto.Object, err error) {
+	var items []*otto.Object
+	for _, d := range ds {
+		var item *otto.Object
+		if item, err = fastjs.Object(r, d.object()); err != nil {
+			return
+		}
+		items = append(items, item)
+	}
+	return fastjs.Array(r, items)
+}
+
+// readDockerMetadata reads digest and size from --metadata-file
+func readDockerMetadata(file string) (digest string, size int64, err error) {
+	var buf []byte
+	if buf, err = os.ReadFile(file); err != nil {
+		return
+	}
+	var metadata struct {
+		Digest     string `json:"containerimage.digest"`
+		Descriptor struct {
+			Size int64 `json:"size"`
+		} `json:"containerimage.descriptor"`
+	}
+	if err = json.Unmarshal(buf, &metadata); err != nil {
+		return
+	}
+	digest, size = metadata.Digest, metadata.Descriptor.Size
+	return
+}
+
+// parseDockerPushDigest parses the digest and size from the output of "docker push"
+func parseDockerPushDigest(output string) (digest string, size int64) {
+	matches := dockerPushDigest.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return
+	}
+	match := matches[len(matches)-1]
+	digest = match[1]
+	size, _ = strconv.ParseInt(match[2], 10, 64)
+	return
+}
+
+// dockerPushOptions are the options of runDockerPush
+type dockerPushOptions struct {
+	concurrency  int
+	retries      int
+	allowFailure bool
+}
+
+// loadDockerPushOptions loads options of runDockerPush
+func loadDockerPushOptions(arg otto.Value) (opts dockerPushOptions, err error) {
+	opts = dockerPushOptions{
+		concurrency: dockerPushConcurrencyDefault,
+		retries:     dockerPushRetriesDefault,
+	}
+	if !arg.IsObject() || arg.Class() != "Object" {
+		return
+	}
+	obj := arg.Object()
+	if err = fastjs.LoadIntField(&opts.concurrency, obj, "concurrency"); err != nil {
+		return
+	}
+	if err = fastjs.LoadIntField(&opts.retries, obj, "retries"); err != nil {
+		return
+	}
+	if err = fastjs.LoadBoolField(&opts.allowFailure, obj, "allowFailure"); err != nil {
+		return
+	}
+	if opts.concurrency < 1 {
+		err = fmt.Errorf("invalid concurrency %d, should be at least 1", opts.concurrency)
+		return
+	}
+	if opts.retries < 0 {
+		err = fmt.Errorf("invalid retries %d, should not be negative", opts.retries)
+		return
+	}
+	return
+}
+
+// dockerPushResult is the result of pushing an image by runDockerPush
+type dockerPushResult struct {
+	*dockerImageDigest
+	status   string
+	attempts int
+	err      error
+}
+
+func (res *dockerPushResult) object() map[string]any {
+	obj := res.dockerImageDigest.object()
+	obj["status"] = res.status
+	obj["attempts"] = res.attempts
+	if res.err != nil {
+		obj["error"] = res.err.Error()
+	}
+	return obj
+}
+
+// createDockerPushArray converts push results for JavaScript
+func (r *Runner) createDockerPushArray(results []*dockerPushResult) (arr *otto.Object, err error) {
+	var items []*otto.Object
+	for _, res := range results {
+		var item *otto.Object
+		if item, err = fastjs.Object(r, res.object()); err != nil {
+			return
+		}
+		items = append(items, item)
+	}
+	return fastjs.Array(r, items)
+}
+
+// isRetryableDockerPushError checks if a push failed transiently
+func isRetryableDockerPushError(err error) bool {
+	if dockerPushRetryable.MatchString(err.Error()) {
+		return true
+	}
+	var ce *commandError
+	return errors.As(err, &ce) && dockerPushRetryable.MatchString(ce.stderr)
+}
+
+// retryDockerPush runs a push with backoff, called from goroutines
+func (r *Runner) retryDockerPush(image string, run dockerPushFunc, retries int) (digest string, size int64, attempts int, err error) {
+	delay := dockerPushRetryDelay
+	for {
+		attempts++
+		if digest, size, err = run(); err == nil {
+			return
+		}
+		if attempts > retries || r.ctx.Err() != nil || !isRetryableDockerPushError(err) {
+			return
+		}
+
+		log.Println("docker push failed, retry in", delay, "image:", image, "attempt:", attempts, "error:", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		delay = min(delay*2, dockerPushRetryMaxDelay)
+	}
+}
+
+// resolveDockerImageReference returns the immutable reference of a pushed image
+func (r *Runner) resolveDockerImageReference(image string) (ref string, err error) {
+	if ref = r.state.docker.digests[image].reference(); ref == "" {
+		err = fmt.Errorf("no digest of image %s, push it with runDockerBuild() or runDockerPush() first", image)
+	}
+	return
+}
+
+func (r *Runner) useDockerDigest(call otto.FunctionCall) otto.Value {
+	var image string
+	if arg := call.Argument(0); arg.IsString() {
+		image = arg.String()
+	} else if len(r.state.docker.images) > 0 {
+		image = r.state.docker.images[0]
+	}
+	d, ok := r.state.docker.digests[image]
+	if !ok {
+		return otto.UndefinedValue()
+	}
+	return rg.Must(fastjs.Object(r, d.object())).Value()
+}
+
+const (
+	dockerCacheTagDefault  = "buildcache"
+	dockerCacheModeDefault = "max"
+	dockerCacheInline      = "inline"
+
+	dockerBuildxDriverDocker = "docker"
+)
+
+// dockerCacheOptions are the options of useDockerCache
+type dockerCacheOptions struct {
+	enabled bool
+	from    []string
+	fromSet bool
+	to      string
+	toSet   bool
+	mode    string
+}
+
+// dockerImageRepository returns the repository of image, without tag and digest
+func dockerImageRepository(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// createDockerCacheSpec expands a cache shorthand into a spec
+func (r *Runner) createDockerCacheSpec(cache string, export bool, mode string) string {
+	if strings.Contains(cache, "=") {
+		return cache
+	}
+
+	var spec string
+	if cache == dockerCacheInline {
+		if !export {
+			// inline cache is imported from the image itself
+			return ""
+		}
+		return "type=inline"
+	} else if strings.HasPrefix(cache, "/") || strings.HasPrefix(cache, ".") {
+		if export {
+			spec = "type=local,dest=" + r.resolvePath(cache)
+		} else {
+			spec = "type=local,src=" + r.resolvePath(cache)
+		}
+	} else {
+		spec = "type=registry,ref=" + cache
+	}
+
+	if export {
+		spec += ",mode=" + mode
+	}
+	return spec
+}
+
+// resolveDockerCache returns cache sources, destination and mode
+func (r *Runner) resolveDockerCache() (from []string, to string, mode string) {
+	opts := r.state.docker.cache
+
+	defaultRef := dockerImageRepository(r.state.docker.images[0]) + ":" + dockerCacheTagDefault
+
+	from, to, mode = opts.from, opts.to, opts.mode
+	if !opts.fromSet {
+		from = []string{defaultRef}
+	}
+	if !opts.toSet {
+		to = defaultRef
+	}
+	if mode == "" {
+		mode = dockerCacheModeDefault
+	}
+	return
+}
+
+// isDockerCacheRegistry checks for a plain registry reference
+func isDockerCacheRegistry(cache string) bool {
+	return !strings.Contains(cache, "=") && cache != dockerCacheInline && !strings.HasPrefix(cache, "/") && !strings.HasPrefix(cache, ".")
+}
+
+// readDockerBuildxDriver returns the driver of current builder, empty if unknown
+func (r *Runner) readDockerBuildxDriver() string {
+	stdout := &bytes.Buffer{}
+	cmd := exec.Command("docker", append(dockerCLIBackend{}.configArgs(r), "buildx", "inspect")...)
+	cmd.Dir = r.state.workdir
+	cmd.Env = rg.Must(r.createEnviron())
+	cmd.Stdout = stdout
+	if err := r.runCommand(cmd); err != nil {
+		return ""
+	}
+	if match := dockerBuildxDriver.FindStringSubmatch(stdout.String()); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// createDockerCacheArgs creates --cache-from and --cache-to arguments of docker build
+func (r *Runner) createDockerCacheArgs() (args []string) {
+	if !r.state.docker.cache.enabled {
+		return
+	}
+
+	from, to, mode := r.resolveDockerCache()
+
+	if to != "" && !r.state.docker.cache.toSet && r.readDockerBuildxDriver() == dockerBuildxDriverDocker {
+		// the default docker driver cannot export cache to a registry
+		log.Println("use docker cache: inline, cache export requires a builder other than the docker driver")
+		to = dockerCacheInline
+	}
+
+	for _, item := range from {
+		if spec := r.createDockerCacheSpec(item, false, mode); spec != "" {
+			args = append(args, "--cache-from", spec)
+		}
+	}
+	if to != "" {
+		args = append(args, "--cache-to", r.createDockerCacheSpec(to, true, mode))
+	}
+	return
+}
+
+func (r *Runner) useDockerCache(call otto.FunctionCall) otto.Value {
+	opts := &r.state.docker.cache
+
+	if arg := call.Argument(0); arg.IsNull() || (arg.IsBoolean() && !rg.Must(arg.ToBoolean())) {
+		*opts = dockerCacheOptions{}
+		log.Println("use docker cache: disabled")
+	} else if arg.IsBoolean() {
+		opts.enabled = true
+		log.Println("use docker cache: enabled")
+	} else if arg.IsObject() {
+		obj := arg.Object()
+		opts.enabled = true
+		if val := rg.Must(obj.Get("from")); !val.IsUndefined() {
+			rg.Must0(fastjs.LoadStringSliceField(&opts.from, obj, "from"))
+			opts.fromSet = true
+		}
+		if val := rg.Must(obj.Get("to")); !val.IsUndefined() {
+			rg.Must0(fastjs.LoadStringField(&opts.to, obj, "to"))
+			opts.toSet = true
+		}
+		rg.Must0(fastjs.LoadStringField(&opts.mode, obj, "mode"))
+		if opts.mode != "" && opts.mode != "min" && opts.mode != "max" {
+			rg.Must0(fmt.Errorf("invalid docker cache mode %s, should be min or max", opts.mode))
+		}
+		log.Println("use docker cache: enabled")
+	}
+
+	if !opts.enabled {
+		return otto.NullValue()
+	}
+	return rg.Must(fastjs.Object(r, map[string]any{
+		"from": opts.from,
+		"to":   opts.to,
+		"mode": opts.mode,
+	})).Value()
+}
+
+// dockerBuildMount is a secret or ssh mount
+type dockerBuildMount struct {
+	id   string
+	spec string
+}
+
+// setDockerBuildMount replaces or removes the mount of id
+func setDockerBuildMount(mounts []dockerBuildMount, id string, spec string) (out []dockerBuildMount) {
+	for _, item := range mounts {
+		if item.id != id {
+			out = append(out, item)
+		}
+	}
+	if spec != "" {
+		out = append(out, dockerBuildMount{id: id, spec: spec})
+	}
+	return
+}
+
+func dockerBuildMountIDs(mounts []dockerBuildMount) (ids []string) {
+	ids = []string{}
+	for _, item := range mounts {
+		ids = append(ids, item.id)
+	}
+	return
+}
+
+func (r *Runner) useDockerBuildSecret(call otto.FunctionCall) otto.Value {
+	if id, arg := call.Argument(0), call.Argument(1); id.IsString() && id.String() != "" {
+		var spec string
+		if arg.IsObject() {
+			var opts struct {
+				env     string
+				file    string
+				content string
+			}
+			obj := arg.Object()
+			rg.Must0(fastjs.LoadStringField(&opts.env, obj, "env"))
+			rg.Must0(fastjs.LoadStringField(&opts.file, obj, "file"))
+			rg.Must0(fastjs.LoadStringField(&opts.content, obj, "content"))
+
+			if opts.env != "" {
+				spec = "id=" + id.String() + ",env=" + opts.env
+			} else if opts.file != "" {
+				spec = "id=" + id.String() + ",src=" + r.resolvePath(opts.file)
+			} else if opts.content != "" {
+				spec = "id=" + id.String() + ",src=" + rg.Must(r.createSecretFile("secret", []byte(opts.content)))
+			} else {
+				rg.Must0(fmt.Errorf("docker build secret %s requires one of env, file and content", id.String()))
+			}
+		} else if !arg.IsNull() {
+			rg.Must0(fmt.Errorf("docker build secret %s should be an object of env, file or content", id.String()))
+		}
+
+		r.state.docker.secrets = setDockerBuildMount(r.state.docker.secrets, id.String(), spec)
+		// only id is logged
+		log.Println("use docker build secret:", id.String())
+	}
+	return rg.Must(fastjs.Array(r, dockerBuildMountIDs(r.state.docker.secrets))).Value()
+}
+
+func (r *Runner) useDockerBuildSSH(call otto.FunctionCall) otto.Value {
+	if id, arg := call.Argument(0), call.Argument(1); id.IsString() && id.String() != "" {
+		var spec string
+		if arg.IsUndefined() {
+			// ssh agent of $SSH_AUTH_SOCK
+			spec = id.String()
+		} else if !arg.IsNull() {
+			var paths []string
+			if arg.IsString() {
+				paths = []string{arg.String()}
+			} else if arg.IsObject() && arg.Class() == "Array" {
+				rg.Must0(json.Unmarshal(rg.Must(arg.Object().MarshalJSON()), &paths))
+			} else {
+				rg.Must0(fmt.Errorf("docker build ssh %s should be a socket or an array of keys", id.String()))
+			}
+			for i, p := range paths {
+				paths[i] = r.resolvePath(p)
+			}
+			spec = id.String() + "=" + strings.Join(paths, ",")
+		}
+
+		r.state.docker.ssh = setDockerBuildMount(r.state.docker.ssh, id.String(), spec)
+		log.Println("use docker build ssh:", id.String())
+	}
+	return rg.Must(fastjs.Array(r, dockerBuildMountIDs(r.state.docker.ssh))).Value()
+}
+
+// dockerBuildOptions are the options of useDockerBuildOptions, passed to "docker buildx build"
+type dockerBuildOptions struct {
+	target   string
+	labels   []string
+	pull     bool
+	noCache  bool
+	network  string
+	addHosts []string
+	shmSize  string
+	ulimits  []string
+	outputs  []string
+}
+
+func loadDockerBuildOptions(out *dockerBuildOptions, obj *otto.Object) (err error) {
+	if err = fastjs.LoadStringField(&out.target, obj, "target"); err != nil {
+		return
+	}
+	if val := rg.Must(obj.Get("labels")); val.IsNull() {
+		out.labels = nil
+	} else if err = loadEnvField(&out.labels, obj, "labels"); err != nil {
+		return
+	}
+	if err = fastjs.LoadBoolField(&out.pull, obj, "pull"); err != nil {
+		return
+	}
+	if err = fastjs.LoadBoolField(&out.noCache, obj, "noCache"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringField(&out.network, obj, "network"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringSliceField(&out.addHosts, obj, "addHosts"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringField(&out.shmSize, obj, "shmSize"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringSliceField(&out.ulimits, obj, "ulimits"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringSliceField(&out.outputs, obj, "outputs"); err != nil {
+		return
+	}
+	return
+}
+
+// createDockerBuildOptionsArgs returns arguments of build options
+func (r *Runner) createDockerBuildOptionsArgs() (args []string) {
+	opts := r.state.docker.options
+	if opts.target != "" {
+		args = append(args, "--target", opts.target)
+	}
+	if opts.pull {
+		args = append(args, "--pull")
+	}
+	if opts.noCache {
+		args = append(args, "--no-cache")
+	}
+	if opts.network != "" {
+		args = append(args, "--network", opts.network)
+	}
+	for _, host := range opts.addHosts {
+		args = append(args, "--add-host", host)
+	}
+	if opts.shmSize != "" {
+		args = append(args, "--shm-size", opts.shmSize)
+	}
+	for _, ulimit := range opts.ulimits {
+		args = append(args, "--ulimit", ulimit)
+	}
+	return
+}
+
+func (r *Runner) useDockerBuildOptions(call otto.FunctionCall) otto.Value {
+	opts := &r.state.docker.options
+	if arg := call.Argument(0); arg.IsNull() {
+		*opts = dockerBuildOptions{}
+		log.Println("use docker build options: reset")
+	} else if arg.IsObject() {
+		rg.Must0(loadDockerBuildOptions(opts, arg.Object()))
+	}
+
+	labels := map[string]any{}
+	for _, item := range opts.labels {
+		key, val, _ := strings.Cut(item, "=")
+		labels[key] = val
+	}
+	return rg.Must(fastjs.Object(r, map[string]any{
+		"target":   opts.target,
+		"labels":   rg.Must(fastjs.Object(r, labels)),
+		"pull":     opts.pull,
+		"noCache":  opts.noCache,
+		"network":  opts.network,
+		"addHosts": opts.addHosts,
+		"shmSize":  opts.shmSize,
+		"ulimits":  opts.ulimits,
+		"outputs":  opts.outputs,
+	})).Value()
+}
+
+const (
+	dockerLabelRevision = "org.opencontainers.image.revision"
+	dockerLabelSource   = "org.opencontainers.image.source"
+	dockerLabelCreated  = "org.opencontainers.image.created"
+)
+
+var (
+	// dockerRevisionEnvKeys are commit hashes set by CI systems
+	dockerRevisionEnvKeys = []string{"GITHUB_SHA", "CI_COMMIT_SHA", "GIT_COMMIT"}
+	// dockerSourceEnvKeys are repository urls set by CI systems
+	dockerSourceEnvKeys = []string{"CI_PROJECT_URL", "GIT_URL"}
+)
+
+// lookupEnv returns the first non-empty environment variable of the keys
+func (r *Runner) lookupEnv(keys ...string) string {
+	for _, key := range keys {
+		if val := rg.Must(r.env.Get(key)); val.IsString() && val.String() != "" {
+			return val.String()
+		}
+	}
+	return ""
+}
+
+// readGitOutput returns trimmed git output, empty on failure
+func (r *Runner) readGitOutput(args ...string) string {
+	stdout := &bytes.Buffer{}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.state.workdir
+	cmd.Env = rg.Must(r.createEnviron())
+	cmd.Stdout = stdout
+	if err := r.runCommand(cmd); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(stdout.String())
+}
+
+// createDockerOCILabels returns OCI labels of revision, source and created
+func (r *Runner) createDockerOCILabels() (labels []string) {
+	revision := r.lookupEnv(dockerRevisionEnvKeys...)
+	if revision == "" {
+		revision = r.readGitOutput("rev-parse", "HEAD")
+	}
+	if revision != "" {
+		labels = append(labels, dockerLabelRevision+"="+revision)
+	}
+
+	source := r.lookupEnv(dockerSourceEnvKeys...)
+	if server, repo := r.lookupEnv("GITHUB_SERVER_URL"), r.lookupEnv("GITHUB_REPOSITORY"); server != "" && repo != "" {
+		source = strings.TrimSuffix(server, "/") + "/" + repo
+	}
+	if source == "" {
+		source = r.readGitOutput("remote", "get-url", "origin")
+	}
+	if source = stripURLCredentials(source); source != "" {
+		labels = append(labels, dockerLabelSource+"="+source)
+	}
+
+	// SOURCE_DATE_EPOCH is respected for reproducible builds
+	created := time.Now().UTC()
+	if epoch, err := strconv.ParseInt(r.lookupEnv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		created = time.Unix(epoch, 0).UTC()
+	}
+	labels = append(labels, dockerLabelCreated+"="+created.Format(time.RFC3339))
+	return
+}
+
+// createDockerLabelArgs returns --label arguments, user labels win
+func (r *Runner) createDockerLabelArgs() (args []string) {
+	var keys []string
+	values := map[string]string{}
+	labels := r.createDockerOCILabels()
+	if r.state.docker.fingerprint != "" {
+		labels = append(labels, dockerFingerprintLabel+"="+r.state.docker.fingerprint)
+	}
+	for _, item := range append(labels, r.state.docker.options.labels...) {
+		key, val, _ := strings.Cut(item, "=")
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = val
+	}
+	for _, key := range keys {
+		args = append(args, "--label", key+"="+values[key])
+	}
+	return
+}
@@ -0,0 +1,265 @@
+package fastci
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	"github.com/yankeguo/rg"
+)
+
+const (
+	dockerBackendDocker  = "docker"
+	dockerBackendPodman  = "podman"
+	dockerBackendBuildah = "buildah"
+	dockerBackendKaniko  = "kaniko"
+)
+
+var (
+	// dockerBackendExecutables are the backends in order of detection
+	dockerBackendExecutables = []struct {
+		name       string
+		executable string
+	}{
+		{dockerBackendDocker, "docker"},
+		{dockerBackendPodman, "podman"},
+		{dockerBackendBuildah, "buildah"},
+		{dockerBackendKaniko, "executor"},
+	}
+)
+
+// dockerBuildOutput is the output of dockerBackend.build
+type dockerBuildOutput struct {
+	digest string
+	size   int64
+	// pushed is true if the images are pushed while building
+	pushed bool
+}
+
+// dockerBackend builds and pushes images
+type dockerBackend interface {
+	// build builds all images and mirrors
+	build(r *Runner) (out dockerBuildOutput, err error)
+	// push prepares a push, run is safe to call concurrently and repeatedly
+	push(r *Runner, image string) (run dockerPushFunc, err error)
+}
+
+// dockerPushFunc runs a prepared push, it must not access the JavaScript runtime
+type dockerPushFunc func() (digest string, size int64, err error)
+
+func createDockerBackend(name string) (backend dockerBackend, err error) {
+	switch name {
+	case dockerBackendDocker:
+		backend = dockerCLIBackend{}
+	case dockerBackendPodman, dockerBackendBuildah:
+		backend = ociBackend{executable: name}
+	case dockerBackendKaniko:
+		backend = kanikoBackend{executable: "executor"}
+	default:
+		err = fmt.Errorf("unknown docker backend %s, should be one of docker, podman, buildah and kaniko", name)
+	}
+	return
+}
+
+// detectDockerBackend returns the first backend found in PATH, default to docker
+func detectDockerBackend() string {
+	for _, item := range dockerBackendExecutables {
+		if _, err := exec.LookPath(item.executable); err == nil {
+			return item.name
+		}
+	}
+	return dockerBackendDocker
+}
+
+// resolveDockerBackend returns the backend in use
+func (r *Runner) resolveDockerBackend() (name string, backend dockerBackend, err error) {
+	if name = r.state.docker.backend; name == "" {
+		name = detectDockerBackend()
+	}
+	backend, err = createDockerBackend(name)
+	return
+}
+
+func (r *Runner) useDockerBackend(call otto.FunctionCall) otto.Value {
+	if arg := call.Argument(0); arg.IsNull() {
+		r.state.docker.backend = ""
+		log.Println("use docker backend: auto")
+	} else if arg.IsString() {
+		rg.Must(createDockerBackend(arg.String()))
+		r.state.docker.backend = arg.String()
+		log.Println("use docker backend:", r.state.docker.backend)
+	}
+	name, _ := rg.Must2(r.resolveDockerBackend())
+	return rg.Must(otto.ToValue(name))
+}
+
+// createDockerBackendCommand creates a command of backend
+func (r *Runner) createDockerBackendCommand(executable string, args []string) (cmd *exec.Cmd, err error) {
+	var env []string
+	if env, err = r.createEnviron(); err != nil {
+		return
+	}
+	cmd = newDockerBackendCommand(r.state.workdir, env, executable, args)
+	return
+}
+
+// newDockerBackendCommand creates a command without the runner
+func newDockerBackendCommand(dir string, env []string, executable string, args []string) *exec.Cmd {
+	log.Println("run", executable+":", strings.Join(args, " "))
+
+	cmd := exec.Command(executable, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// createDockerBuildArgs returns build args as "KEY=value" items
+func (r *Runner) createDockerBuildArgs() (items []string, err error) {
+	for _, key := range r.state.docker.buildArg.Keys() {
+		var val otto.Value
+		if val, err = r.state.docker.buildArg.Get(key); err != nil {
+			return
+		}
+		if !val.IsString() {
+			continue
+		}
+		items = append(items, key+"="+val.String())
+	}
+	return
+}
+
+// resolveDockerBuildContext returns the build context
+func (r *Runner) resolveDockerBuildContext() string {
+	if r.state.docker.buildContext != "" {
+		return r.resolvePath(r.state.docker.buildContext)
+	}
+	return "."
+}
+
+// readDigestFile reads the digest of --digestfile or --digest-file
+func readDigestFile(file string) (digest string, err error) {
+	var buf []byte
+	if buf, err = os.ReadFile(file); err != nil {
+		return
+	}
+	digest = strings.TrimSpace(string(buf))
+	return
+}
+
+// errDockerBackendUnsupported creates an error of a feature not supported by the backend
+func errDockerBackendUnsupported(backend string, feature string) error {
+	return fmt.Errorf("%s is not supported by docker backend %s", feature, backend)
+}
+
+// dockerCLIBackend builds images with "docker buildx build"
+type dockerCLIBackend struct{}
+
+func (dockerCLIBackend) configArgs(r *Runner) (args []string) {
+	if r.state.docker.configPath != "" {
+		args = append(args, "--config", r.resolvePath(r.state.docker.configPath))
+	}
+	return
+}
+
+func (b dockerCLIBackend) build(r *Runner) (out dockerBuildOutput, err error) {
+	defer rg.Guard(&err)
+
+	args := b.configArgs(r)
+
+	// command
+	args = append(args, "buildx", "build")
+
+	// platforms, multiple platforms are pushed, --load cannot hold them
+	multiPlatform := len(r.state.docker.platforms) > 1
+	if len(r.state.docker.platforms) > 0 {
+		args = append(args, "--platform", strings.Join(r.state.docker.platforms, ","))
+	}
+	// outputs replace the default exporter, images are neither loaded nor pushed
+	outputs := r.state.docker.options.outputs
+	out.pushed = multiPlatform && len(outputs) == 0
+	if len(outputs) > 0 {
+		for _, output := range outputs {
+			args = append(args, "--output", output)
+		}
+	} else if multiPlatform {
+		args = append(args, "--push")
+	} else {
+		args = append(args, "--load")
+	}
+	metadataFile := filepath.Join(rg.Must(r.createTempDir()), "metadata.json")
+	args = append(args, "--metadata-file", metadataFile)
+
+	// build args
+	for _, item := range rg.Must(r.createDockerBuildArgs()) {
+		args = append(args, "--build-arg", item)
+	}
+
+	// images
+	for _, image := range r.resolveDockerImages() {
+		args = append(args, "-t", image)
+	}
+
+	// options and labels
+	args = append(args, r.createDockerBuildOptionsArgs()...)
+	args = append(args, r.createDockerLabelArgs()...)
+
+	// cache
+	args = append(args, r.createDockerCacheArgs()...)
+
+	// secrets and ssh, references only
+	for _, item := range r.state.docker.secrets {
+		args = append(args, "--secret", item.spec)
+	}
+	for _, item := range r.state.docker.ssh {
+		args = append(args, "--ssh", item.spec)
+	}
+
+	// dockerfile
+	if r.state.docker.dockerfilePath != "" {
+		args = append(args, "-f", r.resolvePath(r.state.docker.dockerfilePath))
+	}
+
+	// build context
+	args = append(args, r.resolveDockerBuildContext())
+
+	rg.Must0(r.runCommand(rg.Must(r.createDockerBackendCommand("docker", args))))
+
+	// digest of a single platform build is local
+	out.digest, out.size = rg.Must2(readDockerMetadata(metadataFile))
+	if out.pushed && out.digest == "" {
+		err = errors.New("missing containerimage.digest in docker build metadata")
+	}
+	return
+}
+
+func (b dockerCLIBackend) push(r *Runner, image string) (run dockerPushFunc, err error) {
+	args := append(b.configArgs(r), "push", image)
+
+	var env []string
+	if env, err = r.createEnviron(); err != nil {
+		return
+	}
+	dir := r.state.workdir
+
+	run = func() (digest string, size int64, err error) {
+		output := &tailBuffer{limit: dockerPushOutputTailSize}
+
+		cmd := newDockerBackendCommand(dir, env, "docker", args)
+		cmd.Stdout = io.MultiWriter(os.Stdout, output)
+		if err = r.runCommand(cmd); err != nil {
+			return
+		}
+
+		digest, size = parseDockerPushDigest(output.String())
+		return
+	}
+	return
+}
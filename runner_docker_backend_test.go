@@ -0,0 +1,138 @@
+package fastci
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDockerCallsForTest returns calls recorded by fakeDockerForTest
+func fakeDockerCallsForTest(t *testing.T, dir string) []string {
+	buf, err := os.ReadFile(filepath.Join(dir, "calls"))
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(buf)), "\n")
+}
+
+func TestRunnerDockerBackendPodman(t *testing.T) {
+	dir := fakeDockerForTest(t)
+
+	r := runnerForTest(t, `
+	if (useDockerBackend('podman') !== 'podman') {
+		throw new Error('unexpected backend')
+	}
+	useDockerConfig({content: {auths: {}}})
+	useDockerImages('registry.example.com/app:1', 'registry.example.com/app:latest')
+	useDockerBuildArg('VERSION', '1')
+	useDockerfile({path: 'build/Dockerfile'})
+	useDockerBuildContext('build')
+	useDockerCache(true)
+	useDockerBuildSecret('npm', {env: 'NPM_TOKEN'})
+	runDockerBuild()
+	var res = runDockerPush({concurrency: 1})
+	if (res[1].reference !== 'registry.example.com/app@sha256:`+fakeDockerPushDigest+`') {
+		throw new Error('unexpected push result: ' + JSON.stringify(res))
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+
+	authfile := filepath.Join(r.state.docker.configPath, "config.json")
+
+	calls := fakeDockerCallsForTest(t, dir)
+	require.Len(t, calls, 3)
+	require.True(t, strings.HasPrefix(calls[0], "podman build --authfile "+authfile+" --build-arg VERSION=1 -t registry.example.com/app:1 -t registry.example.com/app:latest --label "))
+	require.True(t, strings.HasSuffix(calls[0], " --layers --cache-from registry.example.com/app --cache-to registry.example.com/app --secret id=npm,env=NPM_TOKEN -f build/Dockerfile build"))
+	require.Regexp(t, `^podman push --authfile `+authfile+` --digestfile \S+ registry.example.com/app:1 docker://registry.example.com/app:1$`, calls[1])
+	require.Regexp(t, `^podman push .* docker://registry.example.com/app:latest$`, calls[2])
+}
+
+func TestRunnerDockerBackendBuildahMultiPlatform(t *testing.T) {
+	dir := fakeDockerForTest(t)
+
+	r := runnerForTest(t, `
+	useDockerBackend('buildah')
+	useDockerImages('registry.example.com/app:1', 'registry.example.com/app:latest')
+	useDockerPlatforms('linux/amd64', 'linux/arm64')
+	runDockerBuild()
+	runDockerPush({concurrency: 1})
+	`)
+	defer clearRunnerForTest(t, r)
+
+	calls := fakeDockerCallsForTest(t, dir)
+	require.Len(t, calls, 4)
+	require.True(t, strings.HasPrefix(calls[0], "buildah build --platform linux/amd64,linux/arm64 --manifest registry.example.com/app:1 --label "))
+	require.Equal(t, "buildah tag registry.example.com/app:1 registry.example.com/app:latest", calls[1])
+	require.Regexp(t, `^buildah manifest push --all --digestfile \S+ registry.example.com/app:1 docker://registry.example.com/app:1$`, calls[2])
+	require.Regexp(t, `^buildah manifest push --all .* docker://registry.example.com/app:latest$`, calls[3])
+}
+
+func TestRunnerDockerBackendKaniko(t *testing.T) {
+	dir := fakeDockerForTest(t)
+
+	r := runnerForTest(t, `
+	useDockerBackend('kaniko')
+	useDockerConfig({content: {auths: {}}})
+	useDockerImages('registry.example.com/app:1', 'registry.example.com/app:latest')
+	useDockerPlatforms('linux/arm64')
+	useDockerBuildOptions({target: 'runtime'})
+	useDockerCache(true)
+	var res = runDockerBuild()
+	if (res[0].reference !== 'registry.example.com/app@sha256:`+fakeDockerPushDigest+`') {
+		throw new Error('unexpected build result: ' + JSON.stringify(res))
+	}
+	// already pushed while building
+	runDockerPush()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	calls := fakeDockerCallsForTest(t, dir)
+	require.Len(t, calls, 1)
+	require.Regexp(t, `^executor --context \. --digest-file \S+ --custom-platform linux/arm64 --destination registry.example.com/app:1 --destination registry.example.com/app:latest --target runtime --label .* --cache=true --cache-repo registry.example.com/app$`, calls[0])
+
+	buf, err := os.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.NotContains(t, string(buf), "--config")
+}
+
+func TestRunnerDockerBackendKanikoUnsupported(t *testing.T) {
+	fakeDockerForTest(t)
+
+	err := NewRunner().Execute(context.Background(), `
+	useDockerBackend('kaniko')
+	useDockerImages('app:1')
+	useDockerBuildSecret('npm', {env: 'NPM_TOKEN'})
+	runDockerBuild()
+	`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "build secrets is not supported by docker backend kaniko")
+
+	err = NewRunner().Execute(context.Background(), `
+	useDockerBackend('kaniko')
+	useDockerImages('app:1')
+	useDockerBuildOptions({pull: true})
+	runDockerBuild()
+	`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pull is not supported by docker backend kaniko")
+}
+
+func TestRunnerDockerBackendUnknown(t *testing.T) {
+	err := NewRunner().Execute(context.Background(), `useDockerBackend('containerd')`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown docker backend containerd")
+}
+
+func TestDetectDockerBackend(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PATH", dir)
+	require.Equal(t, "docker", detectDockerBackend())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "executor"), []byte("#!/bin/sh\n"), 0755))
+	require.Equal(t, "kaniko", detectDockerBackend())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "buildah"), []byte("#!/bin/sh\n"), 0755))
+	require.Equal(t, "buildah", detectDockerBackend())
+}
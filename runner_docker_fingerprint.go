@@ -0,0 +1,270 @@
+package fastci
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/yankeguo/fastci/pkg/fastregistry"
+)
+
+const (
+	// dockerFingerprintLabel is the label of fingerprint added to the image
+	dockerFingerprintLabel = "io.github.yankeguo.fastci.fingerprint"
+	// dockerFingerprintTagPrefix is the prefix of tag pointing to the image of fingerprint
+	dockerFingerprintTagPrefix = "fastci-"
+	// dockerFingerprintVersion is changed when the algorithm of fingerprint is changed
+	dockerFingerprintVersion = "fastci-fingerprint-v1"
+)
+
+// dockerignorePattern is a pattern of .dockerignore
+type dockerignorePattern struct {
+	re      *regexp.Regexp
+	negated bool
+}
+
+// dockerignore matches paths relative to the build context
+type dockerignore []dockerignorePattern
+
+// compileDockerignorePattern converts a pattern into a regexp
+func compileDockerignorePattern(pattern string) (re *regexp.Regexp, err error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				// "**/" matches zero or more directories
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					sb.WriteString("(?:.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				err = fmt.Errorf("invalid .dockerignore pattern %q", pattern)
+				return
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// loadDockerignore loads .dockerignore, if any
+func loadDockerignore(dir string) (patterns dockerignore, err error) {
+	var f *os.File
+	if f, err = os.Open(filepath.Join(dir, ".dockerignore")); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var item dockerignorePattern
+		if strings.HasPrefix(line, "!") {
+			item.negated = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(line)), "/")
+		if item.re, err = compileDockerignorePattern(line); err != nil {
+			return
+		}
+		patterns = append(patterns, item)
+	}
+	err = scanner.Err()
+	return
+}
+
+// excludes checks a relative path, the last match wins
+func (patterns dockerignore) excludes(rel string) (excluded bool) {
+	rel = filepath.ToSlash(rel)
+	parts := strings.Split(rel, "/")
+	for _, item := range patterns {
+		for i := range parts {
+			if item.re.MatchString(strings.Join(parts[:i+1], "/")) {
+				excluded = !item.negated
+				break
+			}
+		}
+	}
+	return
+}
+
+// computeDockerFingerprint hashes the inputs of docker build
+func (r *Runner) computeDockerFingerprint() (fingerprint string, err error) {
+	h := sha256.New()
+	fmt.Fprintln(h, dockerFingerprintVersion)
+
+	dir := r.resolveDockerBuildContext()
+	if !filepath.IsAbs(dir) {
+		var wd string
+		if wd, err = r.currentWorkdir(); err != nil {
+			return
+		}
+		dir = filepath.Join(wd, dir)
+	}
+
+	// dockerfile
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	if r.state.docker.dockerfilePath != "" {
+		dockerfile = r.resolvePath(r.state.docker.dockerfilePath)
+	}
+	var buf []byte
+	if buf, err = os.ReadFile(dockerfile); err != nil {
+		return
+	}
+	fmt.Fprintf(h, "dockerfile %x\n", sha256.Sum256(buf))
+
+	// build args, platforms and target
+	var args []string
+	if args, err = r.createDockerBuildArgs(); err != nil {
+		return
+	}
+	slices.Sort(args)
+	for _, item := range args {
+		fmt.Fprintf(h, "arg %q\n", item)
+	}
+	fmt.Fprintf(h, "platforms %q\n", strings.Join(r.state.docker.platforms, ","))
+	fmt.Fprintf(h, "target %q\n", r.state.docker.options.target)
+
+	// build context
+	var ignore dockerignore
+	if ignore, err = loadDockerignore(dir); err != nil {
+		return
+	}
+	if err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		// files may be re-included by negated patterns
+		if d.IsDir() || ignore.excludes(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "file %q %o ", filepath.ToSlash(rel), info.Mode())
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%q\n", target)
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fh := sha256.New()
+		if _, err = io.Copy(fh, f); err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%x\n", fh.Sum(nil))
+		return nil
+	}); err != nil {
+		return
+	}
+
+	fingerprint = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// dockerFingerprintImage returns the image of fingerprint
+func (r *Runner) dockerFingerprintImage(fingerprint string) string {
+	return dockerImageRepository(r.state.docker.images[0]) + ":" + dockerFingerprintTagPrefix + fingerprint
+}
+
+// findDockerFingerprintImage checks if the image of fingerprint exists in the registry
+func (r *Runner) findDockerFingerprintImage(c *fastregistry.Client, fingerprint string) (exists bool, err error) {
+	var ref fastregistry.Reference
+	if ref, err = fastregistry.ParseReference(r.dockerFingerprintImage(fingerprint)); err != nil {
+		return
+	}
+	if _, err = c.GetManifest(r.ctx, ref); err != nil {
+		if fastregistry.IsNotFound(err) {
+			err = nil
+		}
+		return
+	}
+	exists = true
+	return
+}
+
+// tagDockerFingerprint tags the pushed image with the fingerprint
+func (r *Runner) tagDockerFingerprint() (err error) {
+	fingerprint := r.state.docker.fingerprint
+	if fingerprint == "" {
+		return
+	}
+	r.state.docker.fingerprint = ""
+
+	var c *fastregistry.Client
+	if c, err = r.createRegistryClient(); err != nil {
+		return
+	}
+	_, err = r.copyRegistryImage(c, r.state.docker.images[0], r.dockerFingerprintImage(fingerprint))
+	return
+}
+
+// reuseDockerFingerprintImage tags images from the fingerprint image
+func (r *Runner) reuseDockerFingerprintImage(c *fastregistry.Client, fingerprint string) (results []*dockerImageDigest, err error) {
+	src := r.dockerFingerprintImage(fingerprint)
+	log.Println("skip docker build, image of fingerprint exists:", src)
+
+	r.state.docker.digests = map[string]*dockerImageDigest{}
+	for _, image := range r.resolveDockerImages() {
+		var d *dockerImageDigest
+		if d, err = r.copyRegistryImage(c, src, image); err != nil {
+			return
+		}
+		d.platform = strings.Join(r.state.docker.platforms, ",")
+		results = append(results, d)
+	}
+	return
+}
@@ -0,0 +1,136 @@
+package fastci
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDockerignore(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte(`
+# comment
+node_modules
+*.md
+!README.md
+**/*.log
+/build/tmp
+docs/[ab]?.txt
+`), 0644))
+
+	ignore, err := loadDockerignore(dir)
+	require.NoError(t, err)
+
+	for rel, excluded := range map[string]bool{
+		"node_modules":            true,
+		"node_modules/a/index.js": true,
+		"CHANGELOG.md":            true,
+		"README.md":               false,
+		"docs/guide.md":           false,
+		"app.log":                 true,
+		"logs/deep/app.log":       true,
+		"build/tmp/x":             true,
+		"build/out/x":             false,
+		"docs/a1.txt":             true,
+		"docs/c1.txt":             false,
+		"main.go":                 false,
+	} {
+		require.Equal(t, excluded, ignore.excludes(rel), rel)
+	}
+
+	ignore, err = loadDockerignore(t.TempDir())
+	require.NoError(t, err)
+	require.False(t, ignore.excludes("anything"))
+}
+
+// fingerprintContextForTest creates a build context
+func fingerprintContextForTest(t *testing.T) string {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch\nCOPY . /\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.log\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "debug.log"), []byte("1\n"), 0644))
+	return dir
+}
+
+func TestComputeDockerFingerprint(t *testing.T) {
+	dir := fingerprintContextForTest(t)
+
+	r := runnerForTest(t, `
+	useWorkdir('`+dir+`')
+	useDockerImages('app:1')
+	useDockerBuildArg('VERSION', '1')
+	`)
+	defer clearRunnerForTest(t, r)
+
+	fingerprint, err := r.computeDockerFingerprint()
+	require.NoError(t, err)
+	require.Len(t, fingerprint, 64)
+
+	// ignored files are not counted
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "debug.log"), []byte("2\n"), 0644))
+	next, err := r.computeDockerFingerprint()
+	require.NoError(t, err)
+	require.Equal(t, fingerprint, next)
+
+	// source files are counted
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644))
+	next, err = r.computeDockerFingerprint()
+	require.NoError(t, err)
+	require.NotEqual(t, fingerprint, next)
+	fingerprint = next
+
+	// build args are counted
+	require.NoError(t, r.state.docker.buildArg.Set("VERSION", "2"))
+	next, err = r.computeDockerFingerprint()
+	require.NoError(t, err)
+	require.NotEqual(t, fingerprint, next)
+}
+
+func TestRunnerDockerBuildSkipIfExists(t *testing.T) {
+	dir := fakeDockerForTest(t)
+	work := fingerprintContextForTest(t)
+	host, manifests := newFakeRegistryForTest(t)
+	// the fake docker does not push, put the manifest of pushed image
+	manifests["app:1"] = fakeRegistryManifest
+
+	r := runnerForTest(t, `
+	useWorkdir('`+work+`')
+	useDockerImages('`+host+`/app:1')
+	runDockerBuild({skipIfExists: true})
+	runDockerPush()
+	`)
+	clearRunnerForTest(t, r)
+
+	calls := fakeDockerCallsForTest(t, dir)
+	require.Len(t, calls, 2)
+	require.Contains(t, calls[0], "--label io.github.yankeguo.fastci.fingerprint=")
+
+	var tag string
+	for key := range manifests {
+		if strings.HasPrefix(key, "app:fastci-") {
+			tag = key
+		}
+	}
+	require.NotEmpty(t, tag, "fingerprint tag should be pushed")
+	require.Contains(t, calls[0], strings.TrimPrefix(tag, "app:fastci-"))
+
+	// the same content is not built again
+	r = runnerForTest(t, `
+	useWorkdir('`+work+`')
+	useDockerImages('`+host+`/app:2')
+	var res = runDockerBuild({skipIfExists: true})
+	if (res.length !== 1 || res[0].reference === '') {
+		throw new Error('unexpected build result: ' + JSON.stringify(res))
+	}
+	// already pushed
+	runDockerPush()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Len(t, fakeDockerCallsForTest(t, dir), 2)
+	require.Equal(t, fakeRegistryManifest, manifests["app:2"])
+}
@@ -0,0 +1,114 @@
+package fastci
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/yankeguo/rg"
+)
+
+// kanikoBackend builds and pushes images with kaniko executor
+type kanikoBackend struct {
+	executable string
+}
+
+// check returns an error for features kaniko cannot translate
+func (b kanikoBackend) check(r *Runner) error {
+	opts := r.state.docker.options
+	switch {
+	case len(r.state.docker.platforms) > 1:
+		return errDockerBackendUnsupported(dockerBackendKaniko, "multiple platforms")
+	case len(r.state.docker.secrets) > 0:
+		return errDockerBackendUnsupported(dockerBackendKaniko, "build secrets")
+	case len(r.state.docker.ssh) > 0:
+		return errDockerBackendUnsupported(dockerBackendKaniko, "ssh forwarding")
+	case len(opts.outputs) > 0:
+		return errDockerBackendUnsupported(dockerBackendKaniko, "outputs")
+	case opts.pull:
+		// kaniko has no local image store, nor a flag to force pulling
+		return errDockerBackendUnsupported(dockerBackendKaniko, "pull")
+	case opts.network != "" || len(opts.addHosts) > 0 || opts.shmSize != "" || len(opts.ulimits) > 0:
+		return errDockerBackendUnsupported(dockerBackendKaniko, "network, addHosts, shmSize and ulimits")
+	}
+	return nil
+}
+
+// cacheArgs returns --cache and --cache-repo
+func (b kanikoBackend) cacheArgs(r *Runner) (args []string, err error) {
+	if !r.state.docker.cache.enabled || r.state.docker.options.noCache {
+		return
+	}
+	from, to, _ := r.resolveDockerCache()
+
+	repo := to
+	if repo == "" && len(from) > 0 {
+		repo = from[0]
+	}
+	if repo == "" {
+		return
+	}
+	if !isDockerCacheRegistry(repo) {
+		err = errDockerBackendUnsupported(dockerBackendKaniko, "cache "+repo)
+		return
+	}
+	args = append(args, "--cache=true", "--cache-repo", dockerImageRepository(repo))
+	return
+}
+
+func (b kanikoBackend) build(r *Runner) (out dockerBuildOutput, err error) {
+	defer rg.Guard(&err)
+
+	rg.Must0(b.check(r))
+
+	digestFile := filepath.Join(rg.Must(r.createTempDir()), "digest")
+
+	args := []string{
+		"--context", r.resolveDockerBuildContext(),
+		"--digest-file", digestFile,
+	}
+
+	// platform
+	if len(r.state.docker.platforms) > 0 {
+		args = append(args, "--custom-platform", r.state.docker.platforms[0])
+	}
+
+	// build args
+	for _, item := range rg.Must(r.createDockerBuildArgs()) {
+		args = append(args, "--build-arg", item)
+	}
+
+	// images
+	for _, image := range r.resolveDockerImages() {
+		args = append(args, "--destination", image)
+	}
+
+	// options and labels
+	if r.state.docker.options.target != "" {
+		args = append(args, "--target", r.state.docker.options.target)
+	}
+	args = append(args, r.createDockerLabelArgs()...)
+
+	// cache
+	args = append(args, rg.Must(b.cacheArgs(r))...)
+
+	// dockerfile
+	if r.state.docker.dockerfilePath != "" {
+		args = append(args, "--dockerfile", r.resolvePath(r.state.docker.dockerfilePath))
+	}
+
+	cmd := rg.Must(r.createDockerBackendCommand(b.executable, args))
+	// kaniko reads credentials from $DOCKER_CONFIG
+	if r.state.docker.configPath != "" {
+		cmd.Env = append(cmd.Env, "DOCKER_CONFIG="+r.resolvePath(r.state.docker.configPath))
+	}
+	rg.Must0(r.runCommand(cmd))
+
+	out.digest = rg.Must(readDigestFile(digestFile))
+	out.pushed = true
+	return
+}
+
+func (b kanikoBackend) push(r *Runner, image string) (run dockerPushFunc, err error) {
+	err = errors.New("kaniko pushes images while building, use runDockerBuild() instead")
+	return
+}
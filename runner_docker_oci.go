@@ -0,0 +1,137 @@
+package fastci
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/yankeguo/rg"
+)
+
+// ociBackend builds images with podman or buildah
+type ociBackend struct {
+	executable string
+}
+
+// authArgs returns --authfile of useDockerConfig()
+func (b ociBackend) authArgs(r *Runner) (args []string) {
+	if r.state.docker.configPath != "" {
+		args = append(args, "--authfile", filepath.Join(r.resolvePath(r.state.docker.configPath), "config.json"))
+	}
+	return
+}
+
+// cacheArgs returns cache arguments, registry references only
+func (b ociBackend) cacheArgs(r *Runner) (args []string, err error) {
+	if !r.state.docker.cache.enabled {
+		return
+	}
+	from, to, _ := r.resolveDockerCache()
+
+	args = append(args, "--layers")
+	for _, item := range append(from, to) {
+		if item == "" {
+			continue
+		}
+		if !isDockerCacheRegistry(item) {
+			err = errDockerBackendUnsupported(b.executable, "cache "+item)
+			return
+		}
+	}
+	for _, item := range from {
+		args = append(args, "--cache-from", dockerImageRepository(item))
+	}
+	if to != "" {
+		args = append(args, "--cache-to", dockerImageRepository(to))
+	}
+	return
+}
+
+func (b ociBackend) build(r *Runner) (out dockerBuildOutput, err error) {
+	defer rg.Guard(&err)
+
+	args := []string{"build"}
+	args = append(args, b.authArgs(r)...)
+
+	// platforms, multiple platforms go into a manifest list
+	multiPlatform := len(r.state.docker.platforms) > 1
+	if len(r.state.docker.platforms) > 0 {
+		args = append(args, "--platform", strings.Join(r.state.docker.platforms, ","))
+	}
+	for _, output := range r.state.docker.options.outputs {
+		args = append(args, "--output", output)
+	}
+
+	// build args
+	for _, item := range rg.Must(r.createDockerBuildArgs()) {
+		args = append(args, "--build-arg", item)
+	}
+
+	// images
+	if multiPlatform {
+		args = append(args, "--manifest", r.state.docker.images[0])
+	} else {
+		for _, image := range r.resolveDockerImages() {
+			args = append(args, "-t", image)
+		}
+	}
+
+	// options and labels, flags are compatible with docker
+	args = append(args, r.createDockerBuildOptionsArgs()...)
+	args = append(args, r.createDockerLabelArgs()...)
+
+	// cache
+	args = append(args, rg.Must(b.cacheArgs(r))...)
+
+	// secrets and ssh, specs are compatible with docker
+	for _, item := range r.state.docker.secrets {
+		args = append(args, "--secret", item.spec)
+	}
+	for _, item := range r.state.docker.ssh {
+		args = append(args, "--ssh", item.spec)
+	}
+
+	// dockerfile
+	if r.state.docker.dockerfilePath != "" {
+		args = append(args, "-f", r.resolvePath(r.state.docker.dockerfilePath))
+	}
+
+	// build context
+	args = append(args, r.resolveDockerBuildContext())
+
+	rg.Must0(r.runCommand(rg.Must(r.createDockerBackendCommand(b.executable, args))))
+
+	// tag the manifest list with the other images
+	if multiPlatform {
+		for _, image := range r.resolveDockerImages()[1:] {
+			rg.Must0(r.runCommand(rg.Must(r.createDockerBackendCommand(b.executable, []string{"tag", r.state.docker.images[0], image}))))
+		}
+	}
+	return
+}
+
+func (b ociBackend) push(r *Runner, image string) (run dockerPushFunc, err error) {
+	defer rg.Guard(&err)
+
+	digestFile := filepath.Join(rg.Must(r.createTempDir()), "digest")
+
+	var args []string
+	if len(r.state.docker.platforms) > 1 {
+		args = append(args, "manifest", "push", "--all")
+	} else {
+		args = append(args, "push")
+	}
+	args = append(args, b.authArgs(r)...)
+	args = append(args, "--digestfile", digestFile, image, "docker://"+image)
+
+	env := rg.Must(r.createEnviron())
+	dir := r.state.workdir
+
+	run = func() (digest string, size int64, err error) {
+		if err = r.runCommand(newDockerBackendCommand(dir, env, b.executable, args)); err != nil {
+			return
+		}
+		digest, err = readDigestFile(digestFile)
+		return
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package fastci
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	"github.com/yankeguo/fastci/pkg/fastjs"
+)
+
+var (
+	// goStackFrame matches stack frames of Go functions
+	goStackFrame = regexp.MustCompile(`\.go:\d+\)$`)
+)
+
+// ScriptError is returned by Runner.Execute for uncaught exceptions of the script
+type ScriptError struct {
+	err *otto.Error
+}
+
+// Error returns the message with the stack of script
+func (e *ScriptError) Error() string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(e.err.String()), "\n") {
+		if goStackFrame.MatchString(line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// createError converts a Go error into a JavaScript Error
+func (r *Runner) createError(step string, err error) otto.Value {
+	val := r.vm.MakeCustomError("Error", err.Error())
+	obj := val.Object()
+
+	obj.Set("step", step)
+
+	var ce *commandError
+	if errors.As(err, &ce) {
+		obj.Set("exitCode", ce.exitCode)
+		obj.Set("stderr", ce.stderr)
+	}
+
+	// cause is the message of innermost error
+	if cause := errors.Unwrap(err); cause != nil {
+		for next := errors.Unwrap(cause); next != nil; next = errors.Unwrap(cause) {
+			cause = next
+		}
+		obj.Set("cause", cause.Error())
+	}
+	return val
+}
+
+// createFunction throws Go errors as JavaScript exceptions
+func (r *Runner) createFunction(name string, fn fastjs.Function) fastjs.Function {
+	return func(call otto.FunctionCall) otto.Value {
+		prevStep := r.step
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				// runtime errors and cancellation are not catchable
+				if _, isRuntime := recovered.(runtime.Error); isRuntime || context.Cause(r.ctx) != nil {
+					panic(recovered)
+				}
+				// the exception may be caught, so the step is finished
+				r.step = prevStep
+				if err, ok := recovered.(error); ok {
+					panic(r.createError(name, err))
+				}
+				panic(recovered)
+			}
+		}()
+		return fn(call)
+	}
+}
+
+func (r *Runner) setFunction(name string, fn fastjs.Function) {
+	r.vm.Set(name, r.createFunction(name, fn))
+}
+
+func (r *Runner) setStep(name string, fn fastjs.Function) {
+	r.vm.Set(name, r.createFunction(name, r.createStep(name, fn)))
+}
@@ -0,0 +1,75 @@
+package fastci
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunnerErrorCaught(t *testing.T) {
+	r := runnerForTest(t, `
+	useScript('echo oops >&2; exit 3')
+	var caught
+	try {
+		runScript()
+	} catch (e) {
+		caught = e
+	}
+	if (!(caught instanceof Error)) {
+		throw new Error('expected Error, got ' + caught)
+	}
+	if (caught.step !== 'runScript') {
+		throw new Error('unexpected step: ' + caught.step)
+	}
+	if (caught.exitCode !== 3) {
+		throw new Error('unexpected exitCode: ' + caught.exitCode)
+	}
+	if (caught.stderr !== 'oops\n') {
+		throw new Error('unexpected stderr: ' + caught.stderr)
+	}
+	if (caught.message !== 'bash exited with code 3' || caught.cause !== 'exit status 3') {
+		throw new Error('unexpected message: ' + caught.message + ', cause: ' + caught.cause)
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+}
+
+func TestRunnerErrorCaughtFunction(t *testing.T) {
+	r := runnerForTest(t, `
+	var caught
+	try {
+		useGitValues({update: 'not a function'})
+	} catch (e) {
+		caught = e
+	}
+	if (!caught || caught.step !== 'useGitValues' || caught.message !== 'field update should be a function' || caught.exitCode !== undefined) {
+		throw new Error('unexpected error: ' + JSON.stringify(caught))
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+}
+
+func TestRunnerErrorUncaught(t *testing.T) {
+	err := NewRunner().Execute(context.Background(), `
+	useScript('exit 2')
+
+	  runScript()
+	`)
+	var se *ScriptError
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, "Error: bash exited with code 2\n    at <anonymous>:4:4", err.Error())
+}
+
+func TestRunnerErrorCaughtStep(t *testing.T) {
+	// a caught error finishes the step, the timeout blames the script
+	err := NewRunner().Execute(context.Background(), `
+	try {
+		exec(['false'])
+	} catch (e) {}
+	useTimeout(0.3)
+	while (true) {}
+	`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "script interrupted after")
+}
@@ -0,0 +1,300 @@
+package fastci
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	"github.com/yankeguo/fastci/pkg/fastforge"
+	"github.com/yankeguo/fastci/pkg/fastjs"
+	"github.com/yankeguo/rg"
+)
+
+var (
+	nonBranchName = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+)
+
+const (
+	gitPushAttempts = 5
+
+	gitUserNameDefault  = "fastci"
+	gitUserEmailDefault = "fastci@localhost"
+
+	// gitTokenUsername is the username of a token without username
+	gitTokenUsername = "oauth2"
+	// gitCredentialHelper answers credentials from the environment of git
+	gitCredentialHelper = `!f() { test "$1" = get && printf 'username=%s\npassword=%s\n' "$FASTCI_GIT_USERNAME" "$FASTCI_GIT_PASSWORD"; }; f`
+)
+
+// gitMergeRequestOptions are options of merge request
+type gitMergeRequestOptions struct {
+	enabled   bool
+	autoMerge bool
+	forge     string
+	apiURL    string
+}
+
+func loadGitMergeRequestOptions(out *gitMergeRequestOptions, obj *otto.Object) (err error) {
+	if err = fastjs.LoadBoolField(&out.enabled, obj, "mergeRequest"); err != nil {
+		return
+	}
+	if err = fastjs.LoadBoolField(&out.autoMerge, obj, "autoMerge"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringField(&out.forge, obj, "forge"); err != nil {
+		return
+	}
+	if err = fastjs.LoadStringField(&out.apiURL, obj, "apiURL"); err != nil {
+		return
+	}
+	return
+}
+
+// gitValuesTarget describes a values file in a git repository to be patched
+type gitValuesTarget struct {
+	url      string
+	username string
+	password string
+	branch   string
+	file     string
+	update   otto.Value
+
+	mergeRequest gitMergeRequestOptions
+	// forgeRepo is the repository path used by the forge API
+	forgeRepo string
+}
+
+// gitValuesResult is the result of patching a values file
+type gitValuesResult struct {
+	commit          string
+	mergeRequestURL string
+}
+
+// value returns the merge request url, or the commit, or null if nothing changed
+func (res gitValuesResult) value() otto.Value {
+	if res.mergeRequestURL != "" {
+		return rg.Must(otto.ToValue(res.mergeRequestURL))
+	}
+	if res.commit != "" {
+		return rg.Must(otto.ToValue(res.commit))
+	}
+	return otto.NullValue()
+}
+
+// credentialEnv returns environment of a git credential helper
+func (t gitValuesTarget) credentialEnv() (env []string, err error) {
+	var u *url.URL
+	if u, err = url.Parse(t.url); err != nil {
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || (t.username == "" && t.password == "") {
+		return
+	}
+	username := t.username
+	if username == "" {
+		// a token without username, accepted by most forges
+		username = gitTokenUsername
+	}
+	env = []string{
+		// an empty helper resets helpers of user config
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=credential.helper",
+		"GIT_CONFIG_VALUE_0=",
+		"GIT_CONFIG_KEY_1=credential.helper",
+		"GIT_CONFIG_VALUE_1=" + gitCredentialHelper,
+		"FASTCI_GIT_USERNAME=" + username,
+		"FASTCI_GIT_PASSWORD=" + t.password,
+	}
+	return
+}
+
+// parseGitRemote extracts host and path, scp-like syntax supported
+func parseGitRemote(remote string) (host string, repoPath string) {
+	if !strings.Contains(remote, "://") {
+		if before, after, ok := strings.Cut(remote, ":"); ok {
+			if _, h, ok := strings.Cut(before, "@"); ok {
+				before = h
+			}
+			return before, strings.Trim(after, "/")
+		}
+		return "", strings.Trim(remote, "/")
+	}
+	u, err := url.Parse(remote)
+	if err != nil {
+		return
+	}
+	return u.Hostname(), strings.Trim(u.Path, "/")
+}
+
+// isGitNonFastForward checks the stderr of git push for a rejected non-fast-forward update
+func isGitNonFastForward(stderr string) bool {
+	return strings.Contains(stderr, "non-fast-forward") ||
+		strings.Contains(stderr, "fetch first") ||
+		strings.Contains(stderr, "[rejected]")
+}
+
+func (r *Runner) runGit(dir string, args ...string) (stdout string, stderr string, err error) {
+	return r.runGitWithEnv(dir, nil, args...)
+}
+
+// runGitWithEnv runs git with extra environment variables, like credentials
+func (r *Runner) runGitWithEnv(dir string, env []string, args ...string) (stdout string, stderr string, err error) {
+	bufOut, bufErr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if cmd.Env, err = r.createEnviron(); err != nil {
+		return
+	}
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = bufOut
+	cmd.Stderr = io.MultiWriter(bufErr, os.Stderr)
+
+	err = r.runCommand(cmd)
+
+	stdout, stderr = strings.TrimSpace(bufOut.String()), bufErr.String()
+
+	if err != nil {
+		err = fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return
+}
+
+// createGitMergeRequestBranch returns a branch like fastci/<job>-<build>
+func (r *Runner) createGitMergeRequestBranch() string {
+	jobName := rg.Must(r.env.Get("JOB_NAME"))
+	buildNumber := rg.Must(r.env.Get("BUILD_NUMBER"))
+	name := strconv.FormatInt(time.Now().Unix(), 10)
+	if jobName.IsString() && buildNumber.IsString() {
+		name = jobName.String() + "-" + buildNumber.String()
+	}
+	return "fastci/" + strings.Trim(nonBranchName.ReplaceAllString(name, "-"), "-.")
+}
+
+func (r *Runner) createGitCommitMessage(file string) string {
+	jobName := rg.Must(r.env.Get("JOB_NAME"))
+	buildNumber := rg.Must(r.env.Get("BUILD_NUMBER"))
+	if jobName.IsString() && buildNumber.IsString() {
+		return fmt.Sprintf("fastci: update %s by %s #%s", file, jobName.String(), buildNumber.String())
+	}
+	return fmt.Sprintf("fastci: update %s", file)
+}
+
+// openGitMergeRequest opens a merge request, with optional auto merge
+func (r *Runner) openGitMergeRequest(t gitValuesTarget, source string, title string) (mr fastforge.MergeRequestResult, err error) {
+	defer rg.Guard(&err)
+
+	forge := rg.Must(fastforge.New(fastforge.Options{
+		Kind:     t.mergeRequest.forge,
+		APIURL:   t.mergeRequest.apiURL,
+		Repo:     t.forgeRepo,
+		Username: t.username,
+		Token:    t.password,
+	}))
+
+	mr = rg.Must(forge.CreateMergeRequest(r.ctx, fastforge.MergeRequest{
+		SourceBranch: source,
+		TargetBranch: t.branch,
+		Title:        title,
+		Description:  "Created by fastci.",
+	}))
+
+	log.Println("merge request opened:", mr.URL)
+
+	if t.mergeRequest.autoMerge {
+		rg.Must0(forge.EnableAutoMerge(r.ctx, mr))
+		log.Println("merge request auto merge enabled:", mr.URL)
+	}
+	return
+}
+
+// patchGitValues updates the values file in the repository
+func (r *Runner) patchGitValues(t gitValuesTarget) (res gitValuesResult, err error) {
+	defer rg.Guard(&err)
+
+	if t.file == "" {
+		err = errors.New("values file is not set")
+		return
+	}
+
+	credentialEnv := rg.Must(t.credentialEnv())
+
+	dir := rg.Must(r.createTempDir())
+
+	log.Println("clone git repository:", stripURLCredentials(t.url))
+
+	{
+		args := []string{"clone", "--depth", "1"}
+		if t.branch != "" {
+			args = append(args, "--branch", t.branch)
+		}
+		args = append(args, t.url, dir)
+		rg.Must2(r.runGitWithEnv("", credentialEnv, args...))
+	}
+
+	if t.branch == "" {
+		t.branch, _ = rg.Must2(r.runGit(dir, "symbolic-ref", "--short", "HEAD"))
+	}
+
+	if name, _, _ := r.runGit(dir, "config", "--get", "user.name"); name == "" {
+		rg.Must2(r.runGit(dir, "config", "user.name", gitUserNameDefault))
+	}
+	if email, _, _ := r.runGit(dir, "config", "--get", "user.email"); email == "" {
+		rg.Must2(r.runGit(dir, "config", "user.email", gitUserEmailDefault))
+	}
+
+	message := r.createGitCommitMessage(t.file)
+
+	pushBranch, pushArgs := t.branch, []string{"push", "origin"}
+	if t.mergeRequest.enabled {
+		// the generated branch belongs to this build, force push is safe
+		pushBranch, pushArgs = r.createGitMergeRequestBranch(), append(pushArgs, "--force")
+	}
+
+	for attempt := 1; ; attempt++ {
+		if !rg.Must(r.patchYamlFile(filepath.Join(dir, t.file), t.update)) {
+			log.Println("values file not changed:", t.file)
+			return
+		}
+
+		rg.Must2(r.runGit(dir, "add", "--", t.file))
+		rg.Must2(r.runGit(dir, "commit", "-m", message))
+
+		log.Println("push values file:", t.file, "to branch:", pushBranch)
+
+		_, stderr, errPush := r.runGitWithEnv(dir, credentialEnv, append(pushArgs, "HEAD:refs/heads/"+pushBranch)...)
+		if errPush == nil {
+			break
+		}
+		if !isGitNonFastForward(stderr) || attempt >= gitPushAttempts {
+			err = errPush
+			return
+		}
+
+		log.Printf("push rejected, retrying (%d/%d)", attempt, gitPushAttempts)
+
+		rg.Must2(r.runGitWithEnv(dir, credentialEnv, "fetch", "--depth", "1", "origin", t.branch))
+		rg.Must2(r.runGit(dir, "reset", "--hard", "FETCH_HEAD"))
+	}
+
+	res.commit, _ = rg.Must2(r.runGit(dir, "rev-parse", "HEAD"))
+
+	log.Println("values file pushed:", res.commit)
+
+	if t.mergeRequest.enabled {
+		res.mergeRequestURL = rg.Must(r.openGitMergeRequest(t, pushBranch, message)).URL
+	}
+	return
+}
@@ -0,0 +1,341 @@
+package fastci
+
+import (
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func gitForTest(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// createBareRepoForTest creates root/name.git with files on main
+func createBareRepoForTest(t *testing.T, root string, name string, files map[string]string) string {
+	bare := filepath.Join(root, name+".git")
+	require.NoError(t, os.MkdirAll(bare, 0755))
+	gitForTest(t, bare, "init", "--bare", "--initial-branch", "main")
+
+	work := t.TempDir()
+	gitForTest(t, work, "init", "--initial-branch", "main")
+	for file, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(work, file)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(work, file), []byte(content), 0644))
+	}
+	gitForTest(t, work, "add", "-A")
+	gitForTest(t, work, "commit", "-m", "initial")
+	gitForTest(t, work, "push", bare, "HEAD:refs/heads/main")
+	return bare
+}
+
+func TestRunnerDeployCodingValues(t *testing.T) {
+	root := t.TempDir()
+	bare := createBareRepoForTest(t, root, "team/project/repo", map[string]string{
+		"deploy/values.yaml": "# managed by fastci\napp:\n  image: app:1 # image\n",
+	})
+
+	r := runnerForTest(t, `
+	useEnv('JOB_NAME', 'app')
+	useEnv('BUILD_NUMBER', '42')
+	useCodingValues({
+		baseURL: 'file://`+root+`',
+		team: 'team',
+		project: 'project',
+		repo: 'repo',
+		branch: 'main',
+		file: 'deploy/values.yaml',
+		update: function (m) {
+			m.app.image = 'app:' + useEnv('BUILD_NUMBER')
+		},
+	})
+	var commit = deployCodingValues()
+	if (!commit) {
+		throw new Error('commit expected')
+	}
+	if (deployCodingValues() !== null) {
+		throw new Error('no commit expected')
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Equal(t, "# managed by fastci\napp:\n  image: app:42 # image\n", gitForTest(t, bare, "show", "main:deploy/values.yaml")+"\n")
+	require.Equal(t, "fastci: update deploy/values.yaml by app #42", gitForTest(t, bare, "log", "-1", "--format=%s", "main"))
+}
+
+func TestRunnerDeployCodingValuesNonFastForward(t *testing.T) {
+	root := t.TempDir()
+	bare := createBareRepoForTest(t, root, "team/project/repo", map[string]string{
+		"values.yaml": "a: 1\n",
+	})
+
+	// the first update pushes a conflicting commit
+	r := runnerForTest(t, `
+	var calls = 0
+	useScript(
+		'set -e',
+		'work=$(mktemp -d)',
+		'git clone -q `+bare+` $work',
+		'cd $work',
+		'echo "b: 2" >> values.yaml',
+		'git -c user.name=test -c user.email=test@example.com commit -q -am conflict',
+		'git push -q origin HEAD:main'
+	)
+	useCodingValues({
+		baseURL: 'file://`+root+`',
+		team: 'team',
+		project: 'project',
+		repo: 'repo',
+		file: 'values.yaml',
+		update: function (m) {
+			if (calls++ === 0) {
+				runScript()
+			}
+			m.c = calls
+		},
+	})
+	deployCodingValues()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Equal(t, "a: 1\nb: 2\nc: 2", gitForTest(t, bare, "show", "main:values.yaml"))
+}
+
+func TestGitValuesTargetCredentialEnv(t *testing.T) {
+	env, err := gitValuesTarget{
+		url:      "https://e.coding.net/team/project/repo.git",
+		username: "user",
+		password: "secret",
+	}.credentialEnv()
+	require.NoError(t, err)
+
+	// git answers the credentials by the helper
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=e.coding.net\n\n")
+	buf, err := cmd.Output()
+	require.NoError(t, err)
+	require.Contains(t, string(buf), "username=user\npassword=secret\n")
+
+	// a token without username
+	env, err = gitValuesTarget{
+		url:      "https://gitlab.example.com/group/values.git",
+		password: "token",
+	}.credentialEnv()
+	require.NoError(t, err)
+	require.Contains(t, env, "FASTCI_GIT_USERNAME=oauth2")
+	require.Contains(t, env, "FASTCI_GIT_PASSWORD=token")
+
+	env, err = gitValuesTarget{
+		url:      "file:///tmp/repo.git",
+		username: "user",
+	}.credentialEnv()
+	require.NoError(t, err)
+	require.Empty(t, env)
+}
+
+func TestRunnerDeployGitValues(t *testing.T) {
+	root := t.TempDir()
+	bare := createBareRepoForTest(t, root, "group/values", map[string]string{
+		"prod/values.yaml": "image: app:1\n",
+	})
+
+	r := runnerForTest(t, `
+	useGitValues({
+		url: 'file://`+bare+`',
+		branch: 'main',
+		file: 'prod/values.yaml',
+		update: function (m) {
+			m.image = 'app:2'
+		},
+	})
+	deployGitValues()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Equal(t, "image: app:2", gitForTest(t, bare, "show", "main:prod/values.yaml"))
+}
+
+func TestRunnerDeployGitValuesHTTP(t *testing.T) {
+	backend, err := exec.Command("git", "--exec-path").Output()
+	require.NoError(t, err)
+
+	root := t.TempDir()
+	bare := createBareRepoForTest(t, root, "group/values", map[string]string{
+		"values.yaml": "image: app:1\n",
+	})
+	gitForTest(t, bare, "config", "http.receivepack", "true")
+
+	// smart http, requiring basic auth
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, _ := r.BasicAuth(); username != "user" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		(&cgi.Handler{
+			Path: filepath.Join(strings.TrimSpace(string(backend)), "git-http-backend"),
+			Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+		}).ServeHTTP(w, r)
+	}))
+	defer s.Close()
+
+	r := runnerForTest(t, `
+	useGitValues({
+		url: '`+s.URL+`/group/values.git',
+		credentials: {username: 'user', password: 'secret'},
+		branch: 'main',
+		file: 'values.yaml',
+		update: function (m) {
+			m.image = 'app:2'
+		},
+	})
+	deployGitValues()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Equal(t, "image: app:2", gitForTest(t, bare, "show", "main:values.yaml"))
+}
+
+func TestRunnerResolveGitCredentials(t *testing.T) {
+	r := runnerForTest(t, `
+	useEnv('GIT_USERNAME', 'default')
+	useEnv('GIT_PASSWORD', 'default')
+	useEnv('GIT_GITLAB_EXAMPLE_COM_USERNAME', 'hello')
+	useEnv('GIT_GITLAB_EXAMPLE_COM_INFRA_VALUES_PASSWORD', 'world')
+	useGitValues({url: 'https://gitlab.example.com/infra/values.git'})
+	`)
+	username, password := r.resolveGitCredentials()
+	require.Equal(t, "hello", username)
+	require.Equal(t, "world", password)
+
+	r.state.git.values.url = "git@gitea.example.com:infra/values.git"
+	username, password = r.resolveGitCredentials()
+	require.Equal(t, "default", username)
+	require.Equal(t, "default", password)
+
+	r.state.git.values.username = "explicit"
+	username, password = r.resolveGitCredentials()
+	require.Equal(t, "explicit", username)
+	require.Equal(t, "", password)
+}
+
+func TestParseGitRemote(t *testing.T) {
+	host, repoPath := parseGitRemote("https://gitlab.example.com:8443/group/sub/repo.git")
+	require.Equal(t, "gitlab.example.com", host)
+	require.Equal(t, "group/sub/repo.git", repoPath)
+
+	host, repoPath = parseGitRemote("git@github.com:owner/repo.git")
+	require.Equal(t, "github.com", host)
+	require.Equal(t, "owner/repo.git", repoPath)
+
+	host, repoPath = parseGitRemote("file:///srv/git/repo.git")
+	require.Equal(t, "", host)
+	require.Equal(t, "srv/git/repo.git", repoPath)
+}
+
+func TestRunnerDeployGitValuesMergeRequest(t *testing.T) {
+	root := t.TempDir()
+	bare := createBareRepoForTest(t, root, "owner/values", map[string]string{
+		"values.yaml": "image: app:1\n",
+	})
+
+	var requests []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// repository path of a file:// remote contains the temporary directory
+		_, path, _ := strings.Cut(r.URL.Path, "/owner/values/")
+		requests = append(requests, r.Method+" "+path+" "+r.Header.Get("Authorization"))
+		switch path {
+		case "pulls":
+			w.Write([]byte(`{"number": 1, "html_url": "https://gitea.example.com/owner/values/pulls/1"}`))
+		case "pulls/1/merge":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	r := runnerForTest(t, `
+	useEnv('JOB_NAME', 'prod/app')
+	useEnv('BUILD_NUMBER', '7')
+	useGitValues({
+		url: 'file://`+root+`/owner/values.git',
+		credentials: {
+			username: 'fastci',
+			password: 'secret',
+		},
+		branch: 'main',
+		file: 'values.yaml',
+		update: function (m) {
+			m.image = 'app:2'
+		},
+		mergeRequest: true,
+		autoMerge: true,
+		forge: 'gitea',
+		apiURL: '`+s.URL+`/api/v1',
+	})
+	var url = deployGitValues()
+	if (url !== 'https://gitea.example.com/owner/values/pulls/1') {
+		throw new Error('unexpected url: ' + url)
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Equal(t, "image: app:1", gitForTest(t, bare, "show", "main:values.yaml"))
+	require.Equal(t, "image: app:2", gitForTest(t, bare, "show", "fastci/prod-app-7:values.yaml"))
+	require.Equal(t, []string{
+		"POST pulls token secret",
+		"POST pulls/1/merge token secret",
+	}, requests)
+}
+
+func TestRunnerDeployCodingValuesMergeRequest(t *testing.T) {
+	root := t.TempDir()
+	bare := createBareRepoForTest(t, root, "team/project/repo", map[string]string{
+		"values.yaml": "image: app:1\n",
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("Action") == "CreateGitMergeRequest" {
+			w.Write([]byte(`{"Response": {"MergeInfo": {"MergeId": 3}}}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer s.Close()
+
+	r := runnerForTest(t, `
+	useCodingValues({
+		baseURL: 'file://`+root+`',
+		team: 'team',
+		project: 'project',
+		repo: 'repo',
+		branch: 'main',
+		file: 'values.yaml',
+		update: function (m) {
+			m.image = 'app:2'
+		},
+		mergeRequest: true,
+		apiURL: '`+s.URL+`/open-api',
+	})
+	var url = deployCodingValues()
+	if (url !== '`+s.URL+`/p/project/d/repo/git/merge/3') {
+		throw new Error('unexpected url: ' + url)
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Equal(t, "image: app:1", gitForTest(t, bare, "show", "main:values.yaml"))
+}
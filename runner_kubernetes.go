@@ -0,0 +1,544 @@
+package fastci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yankeguo/fastci/pkg/fastkube"
+	"github.com/yankeguo/fastci/pkg/fastregistry"
+	"github.com/yankeguo/rg"
+)
+
+type kubernetesWorkloadResource struct {
+	kind     string
+	group    string
+	version  string
+	resource string
+	// podSpecPath is the path from the workload object to the pod spec
+	podSpecPath []string
+}
+
+var (
+	kubernetesWorkloadResourceDeployment = kubernetesWorkloadResource{
+		kind:        "Deployment",
+		group:       "apps",
+		version:     "v1",
+		resource:    "deployments",
+		podSpecPath: []string{"spec", "template", "spec"},
+	}
+	kubernetesWorkloadResourceStatefulSet = kubernetesWorkloadResource{
+		kind:        "StatefulSet",
+		group:       "apps",
+		version:     "v1",
+		resource:    "statefulsets",
+		podSpecPath: []string{"spec", "template", "spec"},
+	}
+	kubernetesWorkloadResourceDaemonSet = kubernetesWorkloadResource{
+		kind:        "DaemonSet",
+		group:       "apps",
+		version:     "v1",
+		resource:    "daemonsets",
+		podSpecPath: []string{"spec", "template", "spec"},
+	}
+	kubernetesWorkloadResourceCronJob = kubernetesWorkloadResource{
+		kind:        "CronJob",
+		group:       "batch",
+		version:     "v1",
+		resource:    "cronjobs",
+		podSpecPath: []string{"spec", "jobTemplate", "spec", "template", "spec"},
+	}
+
+	kubernetesWorkloadResources = map[string]kubernetesWorkloadResource{
+		"deployment":   kubernetesWorkloadResourceDeployment,
+		"deployments":  kubernetesWorkloadResourceDeployment,
+		"deploy":       kubernetesWorkloadResourceDeployment,
+		"statefulset":  kubernetesWorkloadResourceStatefulSet,
+		"statefulsets": kubernetesWorkloadResourceStatefulSet,
+		"sts":          kubernetesWorkloadResourceStatefulSet,
+		"daemonset":    kubernetesWorkloadResourceDaemonSet,
+		"daemonsets":   kubernetesWorkloadResourceDaemonSet,
+		"ds":           kubernetesWorkloadResourceDaemonSet,
+		"cronjob":      kubernetesWorkloadResourceCronJob,
+		"cronjobs":     kubernetesWorkloadResourceCronJob,
+		"cj":           kubernetesWorkloadResourceCronJob,
+	}
+)
+
+func resolveKubernetesWorkloadResource(kind string) (res kubernetesWorkloadResource, err error) {
+	if kind == "" {
+		res = kubernetesWorkloadResourceDeployment
+		return
+	}
+	var ok bool
+	if res, ok = kubernetesWorkloadResources[strings.ToLower(kind)]; !ok {
+		err = fmt.Errorf("unsupported kubernetes workload kind: %s", kind)
+	}
+	return
+}
+
+func (res kubernetesWorkloadResource) path(namespace string, name string) string {
+	return "/apis/" + res.group + "/" + res.version + "/namespaces/" + namespace + "/" + res.resource + "/" + name
+}
+
+// nestedMap walks the object through keys, returns nil if any of them is missing
+func nestedMap(obj map[string]any, keys ...string) map[string]any {
+	for _, key := range keys {
+		next, ok := obj[key].(map[string]any)
+		if !ok {
+			return nil
+		}
+		obj = next
+	}
+	return obj
+}
+
+// nestedPatch builds a nested patch object from keys and the innermost value
+func nestedPatch(val any, keys ...string) any {
+	for i := len(keys) - 1; i >= 0; i-- {
+		val = map[string]any{keys[i]: val}
+	}
+	return val
+}
+
+type kubernetesWorkloadTarget struct {
+	client    *fastkube.Client
+	resource  kubernetesWorkloadResource
+	namespace string
+	name      string
+	container string
+	init      bool
+}
+
+func (r *Runner) createKubernetesWorkloadTarget() (t kubernetesWorkloadTarget, err error) {
+	defer rg.Guard(&err)
+
+	if r.state.kubernetes.kubeconfigPath == "" {
+		err = errors.New("kubeconfig is not set, use useKubeconfig() first")
+		return
+	}
+
+	t.client = rg.Must(fastkube.NewClient(r.resolvePath(r.state.kubernetes.kubeconfigPath)))
+	t.resource = rg.Must(resolveKubernetesWorkloadResource(r.state.kubernetes.workload.kind))
+
+	t.namespace = r.state.kubernetes.workload.namespace
+	if t.namespace == "" {
+		t.namespace = t.client.Namespace()
+	}
+
+	t.name = r.state.kubernetes.workload.name
+	if t.name == "" {
+		err = errors.New("kubernetes workload name is not set, use useKubernetesWorkload() first")
+		return
+	}
+
+	t.container = r.state.kubernetes.workload.container
+	if t.container == "" {
+		t.container = t.name
+	}
+
+	t.init = r.state.kubernetes.workload.init
+	return
+}
+
+func (t kubernetesWorkloadTarget) String() string {
+	return t.resource.kind + " " + t.namespace + "/" + t.name
+}
+
+func (t kubernetesWorkloadTarget) containersField() string {
+	if t.init {
+		return "initContainers"
+	}
+	return "containers"
+}
+
+func (t kubernetesWorkloadTarget) get(ctx context.Context) (obj map[string]any, err error) {
+	err = t.client.Do(ctx, http.MethodGet, t.resource.path(t.namespace, t.name), nil, "", nil, &obj)
+	return
+}
+
+func (t kubernetesWorkloadTarget) patchImage(ctx context.Context, image string) (err error) {
+	defer rg.Guard(&err)
+
+	obj := rg.Must(t.get(ctx))
+
+	var found bool
+
+	if podSpec := nestedMap(obj, t.resource.podSpecPath...); podSpec != nil {
+		containers, _ := podSpec[t.containersField()].([]any)
+		for _, item := range containers {
+			if container, ok := item.(map[string]any); ok && container["name"] == t.container {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		err = fmt.Errorf("container %q not found in %s of %s", t.container, t.containersField(), t)
+		return
+	}
+
+	patch := nestedPatch(map[string]any{
+		t.containersField(): []any{
+			map[string]any{
+				"name":  t.container,
+				"image": image,
+			},
+		},
+	}, t.resource.podSpecPath...)
+
+	log.Println("patch kubernetes workload:", t.String(), "container:", t.container, "image:", image)
+
+	rg.Must0(t.client.Do(ctx, http.MethodPatch, t.resource.path(t.namespace, t.name), nil, fastkube.ContentTypeStrategicMergePatch, patch, nil))
+	return
+}
+
+const (
+	kubernetesRolloutTimeoutDefault = 5 * time.Minute
+
+	kubernetesDiagnosticsEventsLimit = 20
+	kubernetesDiagnosticsLogsLines   = 50
+)
+
+var (
+	kubernetesRolloutPollInterval = 2 * time.Second
+
+	// kubernetesFailingReasons are container waiting reasons that indicate a failed rollout
+	kubernetesFailingReasons = []string{
+		"CrashLoopBackOff",
+		"ImagePullBackOff",
+		"ErrImagePull",
+		"InvalidImageName",
+		"CreateContainerConfigError",
+		"CreateContainerError",
+		"RunContainerError",
+	}
+)
+
+// nestedInt returns the integer value at the path
+func nestedInt(obj map[string]any, keys ...string) (int64, bool) {
+	if len(keys) == 0 {
+		return 0, false
+	}
+	m := nestedMap(obj, keys[:len(keys)-1]...)
+	if m == nil {
+		return 0, false
+	}
+	switch v := m[keys[len(keys)-1]].(type) {
+	case float64:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// nestedString returns the string value at the path
+func nestedString(obj map[string]any, keys ...string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	m := nestedMap(obj, keys[:len(keys)-1]...)
+	if m == nil {
+		return ""
+	}
+	s, _ := m[keys[len(keys)-1]].(string)
+	return s
+}
+
+// rolloutStatus returns whether the rollout is complete, with progress
+func (t kubernetesWorkloadTarget) rolloutStatus(obj map[string]any) (done bool, msg string, err error) {
+	generation, _ := nestedInt(obj, "metadata", "generation")
+	observedGeneration, _ := nestedInt(obj, "status", "observedGeneration")
+
+	if t.resource.kind != kubernetesWorkloadResourceCronJob.kind && observedGeneration < generation {
+		msg = fmt.Sprintf("waiting for %s spec update to be observed", t)
+		return
+	}
+
+	switch t.resource.kind {
+	case kubernetesWorkloadResourceDeployment.kind:
+		if conditions, ok := nestedMap(obj, "status")["conditions"].([]any); ok {
+			for _, item := range conditions {
+				cond, _ := item.(map[string]any)
+				if cond["type"] == "Progressing" && cond["reason"] == "ProgressDeadlineExceeded" {
+					err = fmt.Errorf("%s exceeded its progress deadline", t)
+					return
+				}
+			}
+		}
+		replicas, ok := nestedInt(obj, "spec", "replicas")
+		if !ok {
+			replicas = 1
+		}
+		updated, _ := nestedInt(obj, "status", "updatedReplicas")
+		current, _ := nestedInt(obj, "status", "replicas")
+		available, _ := nestedInt(obj, "status", "availableReplicas")
+		if updated < replicas {
+			msg = fmt.Sprintf("%d out of %d new replicas have been updated", updated, replicas)
+			return
+		}
+		if current > updated {
+			msg = fmt.Sprintf("%d old replicas are pending termination", current-updated)
+			return
+		}
+		if available < updated {
+			msg = fmt.Sprintf("%d of %d updated replicas are available", available, updated)
+			return
+		}
+	case kubernetesWorkloadResourceStatefulSet.kind:
+		if nestedString(obj, "spec", "updateStrategy", "type") == "OnDelete" {
+			done, msg = true, "update strategy is OnDelete, rollout status is not available"
+			return
+		}
+		replicas, ok := nestedInt(obj, "spec", "replicas")
+		if !ok {
+			replicas = 1
+		}
+		ready, _ := nestedInt(obj, "status", "readyReplicas")
+		updated, _ := nestedInt(obj, "status", "updatedReplicas")
+		if ready < replicas {
+			msg = fmt.Sprintf("%d of %d replicas are ready", ready, replicas)
+			return
+		}
+		if partition, ok := nestedInt(obj, "spec", "updateStrategy", "rollingUpdate", "partition"); ok && partition > 0 {
+			if updated < replicas-partition {
+				msg = fmt.Sprintf("%d of %d new replicas have been updated (partitioned)", updated, replicas-partition)
+				return
+			}
+			break
+		}
+		if updateRevision := nestedString(obj, "status", "updateRevision"); updateRevision != nestedString(obj, "status", "currentRevision") {
+			msg = fmt.Sprintf("%d of %d new replicas have been updated, waiting for revision %s", updated, replicas, updateRevision)
+			return
+		}
+	case kubernetesWorkloadResourceDaemonSet.kind:
+		desired, _ := nestedInt(obj, "status", "desiredNumberScheduled")
+		updated, _ := nestedInt(obj, "status", "updatedNumberScheduled")
+		available, _ := nestedInt(obj, "status", "numberAvailable")
+		if updated < desired {
+			msg = fmt.Sprintf("%d out of %d new pods have been updated", updated, desired)
+			return
+		}
+		if available < desired {
+			msg = fmt.Sprintf("%d of %d updated pods are available", available, desired)
+			return
+		}
+	case kubernetesWorkloadResourceCronJob.kind:
+		done, msg = true, "CronJob has no rollout, it will use the new image on next schedule"
+		return
+	}
+
+	done, msg = true, fmt.Sprintf("%s successfully rolled out", t)
+	return
+}
+
+func (t kubernetesWorkloadTarget) listPods(ctx context.Context, obj map[string]any) (pods []map[string]any, err error) {
+	matchLabels := nestedMap(obj, "spec", "selector", "matchLabels")
+	if len(matchLabels) == 0 {
+		return
+	}
+
+	var selector []string
+	for k, v := range matchLabels {
+		selector = append(selector, fmt.Sprintf("%s=%v", k, v))
+	}
+	slices.Sort(selector)
+
+	var list struct {
+		Items []map[string]any `json:"items"`
+	}
+	if err = t.client.Do(ctx, http.MethodGet, "/api/v1/namespaces/"+t.namespace+"/pods", url.Values{
+		"labelSelector": []string{strings.Join(selector, ",")},
+	}, "", nil, &list); err != nil {
+		return
+	}
+	pods = list.Items
+	return
+}
+
+type kubernetesFailingContainer struct {
+	pod       string
+	container string
+	reason    string
+	message   string
+	restarts  int64
+}
+
+// normalizeImageReference returns the full reference reported by runtimes
+func normalizeImageReference(image string) string {
+	ref, err := fastregistry.ParseReference(image)
+	if err != nil {
+		return image
+	}
+	return ref.String()
+}
+
+// failingContainers finds failing containers running the image
+func (t kubernetesWorkloadTarget) failingContainers(pods []map[string]any, image string) (out []kubernetesFailingContainer) {
+	image = normalizeImageReference(image)
+	for _, pod := range pods {
+		podName := nestedString(pod, "metadata", "name")
+		for _, field := range []string{"initContainerStatuses", "containerStatuses"} {
+			statuses, _ := nestedMap(pod, "status")[field].([]any)
+			for _, item := range statuses {
+				status, _ := item.(map[string]any)
+				if status == nil {
+					continue
+				}
+				if val, _ := status["image"].(string); normalizeImageReference(val) != image {
+					continue
+				}
+				reason := nestedString(status, "state", "waiting", "reason")
+				if !slices.Contains(kubernetesFailingReasons, reason) {
+					continue
+				}
+				restarts, _ := nestedInt(status, "restartCount")
+				out = append(out, kubernetesFailingContainer{
+					pod:       podName,
+					container: nestedString(status, "name"),
+					reason:    reason,
+					message:   nestedString(status, "state", "waiting", "message"),
+					restarts:  restarts,
+				})
+			}
+		}
+	}
+	return
+}
+
+// printDiagnostics prints events and logs of failing containers
+func (t kubernetesWorkloadTarget) printDiagnostics(ctx context.Context, obj map[string]any, image string) {
+	pods, err := t.listPods(ctx, obj)
+	if err != nil {
+		log.Println("failed to list pods:", err.Error())
+	}
+
+	// events
+	{
+		names := []string{t.name}
+		for _, pod := range pods {
+			names = append(names, nestedString(pod, "metadata", "name"))
+		}
+
+		var list struct {
+			Items []map[string]any `json:"items"`
+		}
+		if err := t.client.Do(ctx, http.MethodGet, "/api/v1/namespaces/"+t.namespace+"/events", nil, "", nil, &list); err != nil {
+			log.Println("failed to list events:", err.Error())
+		} else {
+			var events []map[string]any
+			for _, event := range list.Items {
+				if slices.Contains(names, nestedString(event, "involvedObject", "name")) {
+					events = append(events, event)
+				}
+			}
+			eventTime := func(event map[string]any) string {
+				if ts := nestedString(event, "lastTimestamp"); ts != "" {
+					return ts
+				}
+				return nestedString(event, "eventTime")
+			}
+			slices.SortStableFunc(events, func(a, b map[string]any) int {
+				return strings.Compare(eventTime(a), eventTime(b))
+			})
+			if len(events) > kubernetesDiagnosticsEventsLimit {
+				events = events[len(events)-kubernetesDiagnosticsEventsLimit:]
+			}
+			log.Println("recent events of", t.String()+":")
+			for _, event := range events {
+				log.Printf(
+					"  %s %s %s/%s: %s: %s",
+					eventTime(event),
+					nestedString(event, "type"),
+					nestedString(event, "involvedObject", "kind"),
+					nestedString(event, "involvedObject", "name"),
+					nestedString(event, "reason"),
+					nestedString(event, "message"),
+				)
+			}
+		}
+	}
+
+	// logs
+	for _, fc := range t.failingContainers(pods, image) {
+		query := url.Values{
+			"container": []string{fc.container},
+			"tailLines": []string{strconv.Itoa(kubernetesDiagnosticsLogsLines)},
+		}
+		if fc.restarts > 0 {
+			query.Set("previous", "true")
+		}
+		var buf []byte
+		if err := t.client.Do(ctx, http.MethodGet, "/api/v1/namespaces/"+t.namespace+"/pods/"+fc.pod+"/log", query, "", nil, &buf); err != nil {
+			log.Printf("failed to get logs of pod %s container %s: %s", fc.pod, fc.container, err.Error())
+			continue
+		}
+		log.Printf("last logs of pod %s container %s (%s, restarts: %d):\n%s", fc.pod, fc.container, fc.reason, fc.restarts, string(buf))
+	}
+}
+
+// waitRollout polls the workload until the rollout completes, fails or times out
+func (t kubernetesWorkloadTarget) waitRollout(ctx context.Context, image string, timeout time.Duration) (err error) {
+	if timeout <= 0 {
+		timeout = kubernetesRolloutTimeoutDefault
+	}
+
+	log.Println("wait for rollout of", t.String(), "timeout:", timeout.String())
+
+	deadline := time.Now().Add(timeout)
+
+	var (
+		obj     map[string]any
+		lastMsg string
+	)
+
+	for {
+		if obj, err = t.get(ctx); err != nil {
+			return
+		}
+
+		var done bool
+		if done, lastMsg, err = t.rolloutStatus(obj); err != nil {
+			break
+		}
+		if done {
+			log.Println(lastMsg)
+			return
+		}
+		log.Println(lastMsg)
+
+		if pods, errPods := t.listPods(ctx, obj); errPods != nil {
+			log.Println("failed to list pods:", errPods.Error())
+		} else if failing := t.failingContainers(pods, image); len(failing) > 0 {
+			err = fmt.Errorf("pod %s container %s is failing: %s %s", failing[0].pod, failing[0].container, failing[0].reason, failing[0].message)
+			break
+		}
+
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("timed out after %s: %s", timeout.String(), lastMsg)
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(kubernetesRolloutPollInterval):
+		}
+	}
+
+	t.printDiagnostics(ctx, obj, image)
+
+	err = fmt.Errorf("rollout of %s failed: %w", t.String(), err)
+	return
+}
@@ -0,0 +1,349 @@
+package fastci
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeKubernetesServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]map[string]any
+	texts   map[string]string
+	patches []map[string]any
+	onPatch func(obj map[string]any)
+}
+
+func newFakeKubernetesServer(t *testing.T) *fakeKubernetesServer {
+	s := &fakeKubernetesServer{objects: map[string]map[string]any{}, texts: map[string]string{}}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeKubernetesServer) put(path string, obj string) {
+	var m map[string]any
+	if err := json.Unmarshal([]byte(obj), &m); err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[path] = m
+}
+
+func (s *fakeKubernetesServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if text, ok := s.texts[r.URL.Path]; ok {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(text))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	obj, ok := s.objects[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{"kind": "Status", "reason": "NotFound", "message": r.URL.Path + " not found"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(obj)
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/strategic-merge-patch+json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, _ := io.ReadAll(r.Body)
+		var patch map[string]any
+		json.Unmarshal(buf, &patch)
+		s.patches = append(s.patches, patch)
+		if metadata, ok := obj["metadata"].(map[string]any); ok {
+			generation, _ := metadata["generation"].(float64)
+			metadata["generation"] = generation + 1
+		}
+		if s.onPatch != nil {
+			s.onPatch(obj)
+		}
+		json.NewEncoder(w).Encode(obj)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeKubernetesServer) kubeconfig() string {
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	buf, _ := json.Marshal(map[string]any{
+		"apiVersion":      "v1",
+		"kind":            "Config",
+		"current-context": "test",
+		"clusters": []any{
+			map[string]any{"name": "test", "cluster": map[string]any{
+				"server":                     s.URL,
+				"certificate-authority-data": base64.StdEncoding.EncodeToString(ca),
+			}},
+		},
+		"contexts": []any{
+			map[string]any{"name": "test", "context": map[string]any{"cluster": "test", "user": "test", "namespace": "demo"}},
+		},
+		"users": []any{
+			map[string]any{"name": "test", "user": map[string]any{"token": "hello"}},
+		},
+	})
+	return string(buf)
+}
+
+const fakeDeploymentPath = "/apis/apps/v1/namespaces/demo/deployments/app"
+
+const fakeDeployment = `{
+	"metadata": {"name": "app", "namespace": "demo", "generation": 1},
+	"spec": {
+		"replicas": 1,
+		"selector": {"matchLabels": {"app": "app"}},
+		"template": {"spec": {
+			"initContainers": [{"name": "init", "image": "busybox"}],
+			"containers": [{"name": "app", "image": "app:1"}, {"name": "sidecar", "image": "sidecar:1"}]
+		}}
+	}
+}`
+
+func TestRunnerDeployKubernetesWorkload(t *testing.T) {
+	s := newFakeKubernetesServer(t)
+	s.put(fakeDeploymentPath, fakeDeployment)
+
+	r := runnerForTest(t, `
+	useKubeconfig({content: `+s.kubeconfig()+`})
+	useDockerImages('app:2', 'app:latest')
+	useKubernetesWorkload({kind: 'Deployment', name: 'app'})
+	deployKubernetesWorkload()
+	useKubernetesWorkload({container: 'init', init: true})
+	deployKubernetesWorkload()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Len(t, s.patches, 2)
+
+	buf, _ := json.Marshal(s.patches[0])
+	require.JSONEq(t, `{"spec":{"template":{"spec":{"containers":[{"name":"app","image":"app:2"}]}}}}`, string(buf))
+
+	buf, _ = json.Marshal(s.patches[1])
+	require.JSONEq(t, `{"spec":{"template":{"spec":{"initContainers":[{"name":"init","image":"app:2"}]}}}}`, string(buf))
+}
+
+func TestRunnerDeployKubernetesWorkloadDigest(t *testing.T) {
+	fakeDockerForTest(t)
+	s := newFakeKubernetesServer(t)
+	s.put(fakeDeploymentPath, fakeDeployment)
+
+	err := NewRunner().Execute(context.Background(), `
+	useKubeconfig({content: `+s.kubeconfig()+`})
+	useDockerImages('registry.example.com/app:2')
+	useKubernetesWorkload({name: 'app', digest: true})
+	deployKubernetesWorkload()
+	`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no digest of image registry.example.com/app:2")
+	require.Empty(t, s.patches)
+
+	r := runnerForTest(t, `
+	useKubeconfig({content: `+s.kubeconfig()+`})
+	useDockerImages('registry.example.com/app:2')
+	useKubernetesWorkload({name: 'app', digest: true})
+	runDockerBuild()
+	runDockerPush()
+	deployKubernetesWorkload()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Len(t, s.patches, 1)
+
+	buf, _ := json.Marshal(s.patches[0])
+	require.JSONEq(t, `{"spec":{"template":{"spec":{"containers":[{"name":"app","image":"registry.example.com/app@sha256:`+fakeDockerPushDigest+`"}]}}}}`, string(buf))
+}
+
+func TestRunnerDeployKubernetesWorkloadCronJob(t *testing.T) {
+	s := newFakeKubernetesServer(t)
+	s.put("/apis/batch/v1/namespaces/jobs/cronjobs/cleanup", `{
+		"spec": {"jobTemplate": {"spec": {"template": {"spec": {
+			"containers": [{"name": "cleanup", "image": "cleanup:1"}]
+		}}}}}
+	}`)
+
+	r := runnerForTest(t, `
+	useKubeconfig({content: `+s.kubeconfig()+`})
+	useDockerImages('cleanup:2')
+	useKubernetesWorkload({namespace: 'jobs', kind: 'cronjob', name: 'cleanup'})
+	deployKubernetesWorkload()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Len(t, s.patches, 1)
+
+	buf, _ := json.Marshal(s.patches[0])
+	require.JSONEq(t, `{"spec":{"jobTemplate":{"spec":{"template":{"spec":{"containers":[{"name":"cleanup","image":"cleanup:2"}]}}}}}}`, string(buf))
+}
+
+func TestRunnerDeployKubernetesWorkloadContainerNotFound(t *testing.T) {
+	s := newFakeKubernetesServer(t)
+	s.put(fakeDeploymentPath, fakeDeployment)
+
+	err := NewRunner().Execute(context.Background(), `
+	useKubeconfig({content: `+s.kubeconfig()+`})
+	useDockerImages('app:2')
+	useKubernetesWorkload({name: 'app', container: 'missing'})
+	deployKubernetesWorkload()
+	`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `container "missing" not found`)
+	require.Empty(t, s.patches)
+}
+
+func TestRunnerDeployKubernetesWorkloadWait(t *testing.T) {
+	kubernetesRolloutPollInterval = 10 * time.Millisecond
+
+	s := newFakeKubernetesServer(t)
+	s.put(fakeDeploymentPath, fakeDeployment)
+	s.onPatch = func(obj map[string]any) {
+		obj["status"] = map[string]any{
+			"observedGeneration": 2,
+			"replicas":           1,
+			"updatedReplicas":    1,
+			"availableReplicas":  1,
+		}
+	}
+
+	r := runnerForTest(t, `
+	useKubeconfig({content: `+s.kubeconfig()+`})
+	useDockerImages('app:2')
+	useKubernetesWorkload({name: 'app', wait: true, timeout: '10s'})
+	deployKubernetesWorkload()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Len(t, s.patches, 1)
+}
+
+func TestRunnerDeployKubernetesWorkloadWaitFailing(t *testing.T) {
+	kubernetesRolloutPollInterval = 10 * time.Millisecond
+
+	s := newFakeKubernetesServer(t)
+	s.put(fakeDeploymentPath, fakeDeployment)
+	s.onPatch = func(obj map[string]any) {
+		obj["status"] = map[string]any{
+			"observedGeneration": 2,
+			"replicas":           2,
+			"updatedReplicas":    1,
+			"availableReplicas":  1,
+		}
+	}
+	s.put("/api/v1/namespaces/demo/pods", `{"items": [{
+		"metadata": {"name": "app-abc"},
+		"status": {"containerStatuses": [{
+			"name": "app",
+			"image": "app:2",
+			"restartCount": 3,
+			"state": {"waiting": {"reason": "CrashLoopBackOff", "message": "back-off restarting failed container"}}
+		}]}
+	}]}`)
+	s.put("/api/v1/namespaces/demo/events", `{"items": [
+		{"type": "Warning", "reason": "BackOff", "message": "back-off", "lastTimestamp": "2024-01-01T00:00:00Z", "involvedObject": {"kind": "Pod", "name": "app-abc"}},
+		{"type": "Normal", "reason": "Other", "message": "other", "involvedObject": {"kind": "Pod", "name": "other"}}
+	]}`)
+	s.texts["/api/v1/namespaces/demo/pods/app-abc/log"] = "panic: boom\n"
+
+	err := NewRunner().Execute(context.Background(), `
+	useKubeconfig({content: `+s.kubeconfig()+`})
+	useDockerImages('app:2')
+	useKubernetesWorkload({name: 'app', wait: true})
+	deployKubernetesWorkload()
+	`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rollout of Deployment demo/app failed")
+	require.Contains(t, err.Error(), "CrashLoopBackOff")
+}
+
+func TestRunnerDeployKubernetesWorkloadWaitTimeout(t *testing.T) {
+	kubernetesRolloutPollInterval = 10 * time.Millisecond
+
+	s := newFakeKubernetesServer(t)
+	s.put(fakeDeploymentPath, fakeDeployment)
+
+	err := NewRunner().Execute(context.Background(), `
+	useKubeconfig({content: `+s.kubeconfig()+`})
+	useDockerImages('app:2')
+	useKubernetesWorkload({name: 'app', wait: true, timeout: '100ms'})
+	deployKubernetesWorkload()
+	`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out after 100ms")
+}
+
+func TestKubernetesWorkloadFailingContainers(t *testing.T) {
+	pods := []map[string]any{{
+		"metadata": map[string]any{"name": "web-abc"},
+		"status": map[string]any{"containerStatuses": []any{
+			map[string]any{
+				"name":  "web",
+				"image": "docker.io/library/nginx:1.25",
+				"state": map[string]any{"waiting": map[string]any{"reason": "CrashLoopBackOff"}},
+			},
+			map[string]any{
+				"name":  "old",
+				"image": "docker.io/library/nginx:1.24",
+				"state": map[string]any{"waiting": map[string]any{"reason": "CrashLoopBackOff"}},
+			},
+		}},
+	}}
+
+	// the runtime reports the normalized reference of a short image name
+	failing := kubernetesWorkloadTarget{}.failingContainers(pods, "nginx:1.25")
+	require.Len(t, failing, 1)
+	require.Equal(t, "web", failing[0].container)
+
+	require.Len(t, kubernetesWorkloadTarget{}.failingContainers(pods, "docker.io/library/nginx:1.25"), 1)
+	require.Empty(t, kubernetesWorkloadTarget{}.failingContainers(pods, "registry.example.com/nginx:1.25"))
+}
+
+func TestKubernetesWorkloadRolloutStatus(t *testing.T) {
+	sts := kubernetesWorkloadTarget{resource: kubernetesWorkloadResourceStatefulSet, namespace: "demo", name: "db"}
+
+	done, msg, err := sts.rolloutStatus(map[string]any{
+		"metadata": map[string]any{"generation": float64(2)},
+		"spec":     map[string]any{"replicas": float64(3)},
+		"status":   map[string]any{"observedGeneration": float64(2), "readyReplicas": float64(3), "updatedReplicas": float64(1), "currentRevision": "a", "updateRevision": "b"},
+	})
+	require.NoError(t, err)
+	require.False(t, done)
+	require.Contains(t, msg, "waiting for revision b")
+
+	ds := kubernetesWorkloadTarget{resource: kubernetesWorkloadResourceDaemonSet, namespace: "demo", name: "agent"}
+
+	done, _, err = ds.rolloutStatus(map[string]any{
+		"metadata": map[string]any{"generation": float64(2)},
+		"status":   map[string]any{"observedGeneration": float64(2), "desiredNumberScheduled": float64(2), "updatedNumberScheduled": float64(2), "numberAvailable": float64(2)},
+	})
+	require.NoError(t, err)
+	require.True(t, done)
+
+	deploy := kubernetesWorkloadTarget{resource: kubernetesWorkloadResourceDeployment, namespace: "demo", name: "app"}
+
+	_, _, err = deploy.rolloutStatus(map[string]any{
+		"status": map[string]any{"conditions": []any{map[string]any{"type": "Progressing", "reason": "ProgressDeadlineExceeded"}}},
+	})
+	require.Error(t, err)
+}
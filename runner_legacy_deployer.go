@@ -94,13 +94,13 @@ func (r *Runner) useLegacyDeployer(opts legacyDeployerOptions) (err error) {
 
 	// try read the manifest file content
 	if opts.Manifest == "" {
-		if bufManifest, err = os.ReadFile("deployer.yml"); err != nil {
-			if bufManifest, err = os.ReadFile("deployer.yaml"); err != nil {
+		if bufManifest, err = os.ReadFile(r.resolvePath("deployer.yml")); err != nil {
+			if bufManifest, err = os.ReadFile(r.resolvePath("deployer.yaml")); err != nil {
 				err = nil
 			}
 		}
 	} else {
-		bufManifest = rg.Must(os.ReadFile(opts.Manifest))
+		bufManifest = rg.Must(os.ReadFile(r.resolvePath(opts.Manifest)))
 	}
 
 	var header struct {
@@ -182,10 +182,10 @@ func (r *Runner) useLegacyDeployerVersion1(opts legacyDeployerOptions, manifest
 			}
 		)
 
-		baseDir := "."
+		baseDir := r.resolvePath(".")
 
 		if opts.Manifest != "" {
-			baseDir = filepath.Base(opts.Manifest)
+			baseDir = filepath.Dir(r.resolvePath(opts.Manifest))
 		}
 
 		// compose build
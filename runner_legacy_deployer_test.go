@@ -1 +1,39 @@
 package fastci
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunnerUseDeployerManifestInSubdirectory(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	require.NoError(t, os.MkdirAll(filepath.Join(home, ".deployer"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(home, ".deployer", "preset-eco.yml"), []byte("registry: registry.example.com\n"), 0644))
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "deployer.yml"), []byte("vars:\n  name: app\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "docker-build.staging.sh"), []byte("make {{__name__}}"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "Dockerfile.staging"), []byte("FROM {{__name__}}"), 0644))
+
+	// build script and Dockerfile are found next to the manifest
+	r := runnerForTest(t, `
+	useWorkdir('`+dir+`')
+	useDeployer({cluster: 'eco', workload: 'app', profile: 'staging', version: '1', manifest: 'sub/deployer.yml'})
+	`)
+	defer clearRunnerForTest(t, r)
+
+	buf, err := os.ReadFile(r.state.script.path)
+	require.NoError(t, err)
+	require.Equal(t, "make app", string(buf))
+
+	buf, err = os.ReadFile(r.state.docker.dockerfilePath)
+	require.NoError(t, err)
+	require.Equal(t, "FROM app", string(buf))
+
+	require.Equal(t, []string{"registry.example.com/app:staging", "registry.example.com/app:staging-1"}, r.state.docker.images)
+}
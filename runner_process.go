@@ -0,0 +1,239 @@
+package fastci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	"github.com/yankeguo/fastci/pkg/fastjs"
+)
+
+// SignalError is the cancellation cause when stopped by a signal
+type SignalError struct {
+	Signal os.Signal
+}
+
+func (e *SignalError) Error() string {
+	return "received signal: " + e.Signal.String()
+}
+
+var (
+	// processGracePeriod is the delay between terminating and killing
+	processGracePeriod = 10 * time.Second
+	// processOutputWaitDelay is the wait for output held by background processes
+	processOutputWaitDelay = 5 * time.Second
+)
+
+const (
+	// commandStderrTailSize is the max size of stderr kept in commandError
+	commandStderrTailSize = 16 * 1024
+	// commandCaptureLimit is the max size of captured stdout and stderr, each
+	commandCaptureLimit = 1024 * 1024
+)
+
+// tailBuffer keeps the last limit bytes written
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (n int, err error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.buf = b.buf[len(b.buf)-b.limit:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
+
+// limitedBuffer keeps the first limit bytes written, and discards the rest
+type limitedBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (n int, err error) {
+	if remaining := b.limit - len(b.buf); remaining < len(p) {
+		b.buf = append(b.buf, p[:max(remaining, 0)]...)
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return string(b.buf)
+}
+
+// commandError is returned by runCommand when the command exits with a non-zero code
+type commandError struct {
+	name     string
+	exitCode int
+	stderr   string
+	err      error
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", e.name, e.exitCode)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// runCommand runs the command in a new process group
+func (r *Runner) runCommand(cmd *exec.Cmd) (err error) {
+	setProcessGroup(cmd)
+
+	stderr := &tailBuffer{limit: commandStderrTailSize}
+	if cmd.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+	} else {
+		cmd.Stderr = stderr
+	}
+	cmd.WaitDelay = processOutputWaitDelay
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		// output is still held by background processes
+		if errors.Is(err, exec.ErrWaitDelay) {
+			err = nil
+		}
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			err = &commandError{
+				name:     filepath.Base(cmd.Path),
+				exitCode: ee.ExitCode(),
+				stderr:   stderr.String(),
+				err:      err,
+			}
+		}
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		return
+	case <-r.ctx.Done():
+	}
+
+	// forward the signal if the pipeline is stopped by a signal
+	var (
+		sig os.Signal
+		se  *SignalError
+	)
+	if errors.As(context.Cause(r.ctx), &se) {
+		sig = se.Signal
+	}
+
+	log.Println("terminate process:", cmd.Path, "pid:", cmd.Process.Pid)
+	terminateProcessGroup(cmd.Process, sig)
+
+	select {
+	case <-done:
+	case <-time.After(processGracePeriod):
+		log.Println("kill process:", cmd.Path, "pid:", cmd.Process.Pid)
+		killProcessGroup(cmd.Process)
+		<-done
+	}
+
+	err = context.Cause(r.ctx)
+	return
+}
+
+// commandOptions are the common options of runScript and exec
+type commandOptions struct {
+	capture      bool
+	allowFailure bool
+}
+
+func loadCommandOptions(out *commandOptions, obj *otto.Object) (err error) {
+	if err = fastjs.LoadBoolField(&out.capture, obj, "capture"); err != nil {
+		return
+	}
+	if err = fastjs.LoadBoolField(&out.allowFailure, obj, "allowFailure"); err != nil {
+		return
+	}
+	return
+}
+
+// loadEnvField loads an object of environment variables as "KEY=value" items
+func loadEnvField(out *[]string, obj *otto.Object, name string) (err error) {
+	var val otto.Value
+	if val, err = obj.Get(name); err != nil {
+		return
+	}
+	if !val.IsObject() {
+		return
+	}
+	var items []string
+	for _, key := range val.Object().Keys() {
+		var item otto.Value
+		if item, err = val.Object().Get(key); err != nil {
+			return
+		}
+		items = append(items, key+"="+item.String())
+	}
+	*out = items
+	return
+}
+
+// runCommandForResult runs the command and returns its result
+func (r *Runner) runCommandForResult(cmd *exec.Cmd, opts commandOptions) (res map[string]any, err error) {
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	stdout := &limitedBuffer{limit: commandCaptureLimit}
+	stderr := &limitedBuffer{limit: commandCaptureLimit}
+	if opts.capture {
+		cmd.Stdout = io.MultiWriter(os.Stdout, stdout)
+		cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	}
+
+	start := time.Now()
+	err = r.runCommand(cmd)
+	duration := time.Since(start)
+
+	var (
+		exitCode int
+		ce       *commandError
+	)
+	if opts.allowFailure && errors.As(err, &ce) {
+		log.Println("command failed, allowed:", err.Error())
+		exitCode, err = ce.exitCode, nil
+	}
+	if err != nil {
+		return
+	}
+
+	if stdout.truncated || stderr.truncated {
+		log.Printf("command output exceeds %d bytes, truncated", commandCaptureLimit)
+	}
+
+	res = map[string]any{
+		"exitCode":   exitCode,
+		"durationMs": duration.Milliseconds(),
+	}
+	if opts.capture {
+		res["stdout"] = stdout.String()
+		res["stderr"] = stderr.String()
+	}
+	return
+}
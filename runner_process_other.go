@@ -0,0 +1,19 @@
+//go:build !unix
+
+package fastci
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcessGroup kills the process directly
+func terminateProcessGroup(p *os.Process, sig os.Signal) {
+	_ = p.Kill()
+}
+
+func killProcessGroup(p *os.Process) {
+	_ = p.Kill()
+}
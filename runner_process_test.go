@@ -0,0 +1,162 @@
+package fastci
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunnerExecuteDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := NewRunner().Execute(ctx, `while (true) {}`)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Contains(t, err.Error(), "script interrupted")
+}
+
+func TestRunnerExecuteDeadlineTryCatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := NewRunner().Execute(ctx, `
+	while (true) {
+		try {
+			while (true) {}
+		} catch (e) {
+		}
+	}
+	`)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRunnerExecuteCancelScript(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	r := NewRunner()
+	start := time.Now()
+	err := r.Execute(ctx, `
+	useScript('sleep 30 & wait')
+	runScript()
+	`)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Contains(t, err.Error(), "runScript interrupted")
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// temporary directories are still cleaned
+	require.Empty(t, r.tempDirs)
+}
+
+func TestRunnerExecuteCancelScriptGracePeriod(t *testing.T) {
+	defer func(d time.Duration) { processGracePeriod = d }(processGracePeriod)
+	processGracePeriod = 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	dir := t.TempDir()
+
+	start := time.Now()
+	err := NewRunner().Execute(ctx, `
+	useScript("trap '' TERM; sleep 30; touch `+dir+`/finished")
+	runScript()
+	`)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	_, err = os.Stat(dir + "/finished")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRunnerStepTimeout(t *testing.T) {
+	start := time.Now()
+	err := NewRunner().Execute(context.Background(), `
+	useScript('sleep 30')
+	runScript({timeout: '200ms'})
+	`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TimeoutError: runScript timed out after")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRunnerStepTimeoutCaught(t *testing.T) {
+	r := runnerForTest(t, `
+	useScript('sleep 30')
+	var caught
+	try {
+		runScript({timeout: 0.2})
+	} catch (e) {
+		caught = e
+	}
+	if (!caught || caught.name !== 'TimeoutError') {
+		throw new Error('expected TimeoutError, got ' + caught)
+	}
+	useScript('true')
+	runScript()
+	`)
+	defer clearRunnerForTest(t, r)
+}
+
+func TestRunnerUseTimeout(t *testing.T) {
+	start := time.Now()
+	err := NewRunner().Execute(context.Background(), `
+	if (useTimeout() !== null) {
+		throw new Error('unexpected timeout')
+	}
+	if (useTimeout('300ms') !== '300ms') {
+		throw new Error('unexpected timeout')
+	}
+	useScript('sleep 30')
+	runScript()
+	`)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Contains(t, err.Error(), "runScript interrupted after")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRunnerExecuteSignal(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(300*time.Millisecond, func() {
+		cancel(&SignalError{Signal: syscall.SIGINT})
+	})
+
+	dir := t.TempDir()
+
+	r := NewRunner()
+	err := r.Execute(ctx, `
+	useScript("trap 'echo int > `+dir+`/signal; exit 1' INT; sleep 30")
+	runScript()
+	`)
+
+	var se *SignalError
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, syscall.SIGINT, se.Signal)
+	require.Contains(t, err.Error(), "runScript interrupted after")
+	require.Empty(t, r.tempDirs)
+
+	buf, err := os.ReadFile(dir + "/signal")
+	require.NoError(t, err)
+	require.Equal(t, "int\n", string(buf))
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{limit: 5}
+	b.Write([]byte("abc"))
+	require.False(t, b.truncated)
+	b.Write([]byte("defg"))
+	b.Write([]byte("h"))
+	require.True(t, b.truncated)
+	require.Equal(t, "abcde", b.String())
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{limit: 5}
+	b.Write([]byte("abc"))
+	b.Write([]byte("defg"))
+	require.Equal(t, "cdefg", b.String())
+}
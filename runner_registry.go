@@ -0,0 +1,361 @@
+package fastci
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	"github.com/yankeguo/fastci/pkg/fastjs"
+	"github.com/yankeguo/fastci/pkg/fastregistry"
+	"github.com/yankeguo/rg"
+)
+
+// resolveDockerConfigFile returns config.json in use, empty if not found
+func (r *Runner) resolveDockerConfigFile() string {
+	var dir string
+	if r.state.docker.configPath != "" {
+		dir = r.resolvePath(r.state.docker.configPath)
+	} else if val := r.lookupEnv("DOCKER_CONFIG"); val != "" {
+		dir = val
+	} else if home, err := os.UserHomeDir(); err == nil {
+		dir = filepath.Join(home, ".docker")
+	}
+	if dir == "" {
+		return ""
+	}
+	file := filepath.Join(dir, "config.json")
+	if _, err := os.Stat(file); err != nil {
+		return ""
+	}
+	return file
+}
+
+// createRegistryClient creates a registry client with credentials of the docker config
+func (r *Runner) createRegistryClient() (c *fastregistry.Client, err error) {
+	var opts fastregistry.Options
+	if file := r.resolveDockerConfigFile(); file != "" {
+		if opts.Config, err = fastregistry.LoadDockerConfig(file); err != nil {
+			return
+		}
+	}
+	c = fastregistry.NewClient(opts)
+	return
+}
+
+// copyRegistryImage copies an image and records the digest
+func (r *Runner) copyRegistryImage(c *fastregistry.Client, src string, dst string) (d *dockerImageDigest, err error) {
+	var srcRef, dstRef fastregistry.Reference
+	if srcRef, err = fastregistry.ParseReference(src); err != nil {
+		return
+	}
+	if dstRef, err = fastregistry.ParseReference(dst); err != nil {
+		return
+	}
+
+	log.Println("copy image:", src, "to:", dst)
+
+	var m *fastregistry.Manifest
+	if m, err = c.Copy(r.ctx, srcRef, dstRef); err != nil {
+		err = fmt.Errorf("failed to copy image %s to %s: %w", src, dst, err)
+		return
+	}
+
+	log.Println("image copied:", dst, "digest:", m.Digest)
+
+	d = &dockerImageDigest{image: dst, digest: m.Digest, size: int64(len(m.Body)), pushed: true}
+	if r.state.docker.digests == nil {
+		r.state.docker.digests = map[string]*dockerImageDigest{}
+	}
+	r.state.docker.digests[dst] = d
+	return
+}
+
+func (r *Runner) copyImage(call otto.FunctionCall) otto.Value {
+	src, dst := call.Argument(0), call.Argument(1)
+	if !src.IsString() || !dst.IsString() {
+		rg.Must0(errors.New("copyImage requires source and destination images"))
+	}
+	c := rg.Must(r.createRegistryClient())
+	d := rg.Must(r.copyRegistryImage(c, src.String(), dst.String()))
+	return rg.Must(fastjs.Object(r, d.object())).Value()
+}
+
+func (r *Runner) tagImage(call otto.FunctionCall) otto.Value {
+	src := call.Argument(0)
+	if !src.IsString() {
+		rg.Must0(errors.New("tagImage requires a source image"))
+	}
+	srcRef := rg.Must(fastregistry.ParseReference(src.String()))
+
+	// tags as arguments, or an array
+	var tags []string
+	if first := call.Argument(1); first.IsObject() && first.Class() == "Array" {
+		rg.Must0(json.Unmarshal(rg.Must(first.Object().MarshalJSON()), &tags))
+	} else {
+		for _, val := range call.ArgumentList[1:] {
+			tags = append(tags, val.String())
+		}
+	}
+	if len(tags) == 0 {
+		rg.Must0(errors.New("tagImage requires at least one tag"))
+	}
+
+	c := rg.Must(r.createRegistryClient())
+
+	var results []*dockerImageDigest
+	for _, tag := range tags {
+		if !fastregistry.IsValidTag(tag) {
+			rg.Must0(fmt.Errorf("invalid tag %q", tag))
+		}
+		results = append(results, rg.Must(r.copyRegistryImage(c, src.String(), srcRef.WithTag(tag).String())))
+	}
+	return rg.Must(r.createDockerDigestArray(results)).Value()
+}
+
+func (r *Runner) inspectImage(call otto.FunctionCall) otto.Value {
+	arg := call.Argument(0)
+	if !arg.IsString() {
+		rg.Must0(errors.New("inspectImage requires an image"))
+	}
+	ref := rg.Must(fastregistry.ParseReference(arg.String()))
+
+	c := rg.Must(r.createRegistryClient())
+	img := rg.Must(c.Inspect(r.ctx, ref))
+
+	var platforms []string
+	for _, p := range img.Platforms {
+		platforms = append(platforms, p.String())
+	}
+	var created string
+	if !img.Created.IsZero() {
+		created = img.Created.UTC().Format(time.RFC3339)
+	}
+	labels := map[string]any{}
+	for k, v := range img.Labels {
+		labels[k] = v
+	}
+
+	return rg.Must(fastjs.Object(r, map[string]any{
+		"image":     arg.String(),
+		"mediaType": img.MediaType,
+		"digest":    img.Digest,
+		"size":      img.Size,
+		"reference": dockerImageRepository(arg.String()) + "@" + img.Digest,
+		"platforms": rg.Must(fastjs.Array(r, platforms)),
+		"created":   created,
+		"labels":    rg.Must(fastjs.Object(r, labels)),
+	})).Value()
+}
+
+// dockerRegistry is an item of useDockerRegistries
+type dockerRegistry struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// host returns the registry host, without namespace
+func (item dockerRegistry) host() string {
+	host, _, _ := strings.Cut(item.Registry, "/")
+	return host
+}
+
+// mirror returns the image on the registry
+func (item dockerRegistry) mirror(image string) string {
+	name := image
+	if first, rest, ok := strings.Cut(image, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		name = rest
+	}
+	if host, namespace, ok := strings.Cut(item.Registry, "/"); ok {
+		return host + "/" + namespace + "/" + path.Base(name)
+	}
+	return item.Registry + "/" + name
+}
+
+// validate checks the registry
+func (item dockerRegistry) validate() (err error) {
+	host := item.host()
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		err = fmt.Errorf("invalid docker registry %q, should be a host with an optional namespace, like harbor.example.com/team", item.Registry)
+		return
+	}
+	if _, err = fastregistry.ParseReference(item.mirror("app:1")); err != nil {
+		err = fmt.Errorf("invalid docker registry %q: %w", item.Registry, err)
+		return
+	}
+	if (item.Username == "") != (item.Password == "") {
+		err = fmt.Errorf("both username and password are required for docker registry %q", item.Registry)
+		return
+	}
+	return
+}
+
+// resolveDockerImages returns images followed by their mirrors
+func (r *Runner) resolveDockerImages() (images []string) {
+	images = slices.Clone(r.state.docker.images)
+	for _, item := range r.state.docker.registries {
+		for _, image := range r.state.docker.images {
+			if mirror := item.mirror(image); !slices.Contains(images, mirror) {
+				images = append(images, mirror)
+			}
+		}
+	}
+	return
+}
+
+// mergeDockerConfigAuths merges credentials into docker config.json
+func mergeDockerConfigAuths(buf []byte, registries []dockerRegistry) (out []byte, err error) {
+	cfg := map[string]any{}
+	if len(bytes.TrimSpace(buf)) > 0 {
+		if err = json.Unmarshal(buf, &cfg); err != nil {
+			err = fmt.Errorf("failed to parse docker config: %w", err)
+			return
+		}
+	}
+	auths, _ := cfg["auths"].(map[string]any)
+	if auths == nil {
+		auths = map[string]any{}
+	}
+	for _, item := range registries {
+		if item.Username == "" {
+			continue
+		}
+		auths[item.host()] = map[string]any{
+			"auth": base64.StdEncoding.EncodeToString([]byte(item.Username + ":" + item.Password)),
+		}
+	}
+	cfg["auths"] = auths
+	return json.Marshal(cfg)
+}
+
+// dockerMergedConfig is a docker config with credentials, and its base
+type dockerMergedConfig struct {
+	path string
+	base string
+}
+
+// hasDockerRegistryCredentials checks if any registry of useDockerRegistries() has credentials
+func (r *Runner) hasDockerRegistryCredentials() bool {
+	return slices.ContainsFunc(r.state.docker.registries, func(item dockerRegistry) bool {
+		return item.Username != ""
+	})
+}
+
+// persistDockerConfig writes a private docker config
+func (r *Runner) persistDockerConfig(buf []byte) (dir string, err error) {
+	var file string
+	if file, err = r.createSecretFile("config.json", bytes.TrimSpace(buf)); err != nil {
+		return
+	}
+	dir = filepath.Dir(file)
+	return
+}
+
+// restoreDockerConfig drops the docker config merged with credentials
+func (r *Runner) restoreDockerConfig() {
+	merged := &r.state.docker.mergedConfig
+	if merged.path != "" && r.state.docker.configPath == merged.path {
+		r.state.docker.configPath = merged.base
+		log.Println("use docker config without credentials of docker registries")
+	}
+	*merged = dockerMergedConfig{}
+}
+
+// mergeDockerRegistryCredentials copies the docker config with credentials
+func (r *Runner) mergeDockerRegistryCredentials() (err error) {
+	r.restoreDockerConfig()
+	if !r.hasDockerRegistryCredentials() {
+		return
+	}
+	var buf []byte
+	if file := r.resolveDockerConfigFile(); file != "" {
+		if buf, err = os.ReadFile(file); err != nil {
+			return
+		}
+	}
+	if buf, err = mergeDockerConfigAuths(buf, r.state.docker.registries); err != nil {
+		return
+	}
+	base := r.state.docker.configPath
+	if r.state.docker.configPath, err = r.persistDockerConfig(buf); err != nil {
+		return
+	}
+	r.state.docker.mergedConfig = dockerMergedConfig{path: r.state.docker.configPath, base: base}
+	log.Println("use docker config with credentials of docker registries")
+	return
+}
+
+func (r *Runner) useDockerConfig(call otto.FunctionCall) otto.Value {
+	fastjs.GetterSetterForLongString(r, &r.state.docker.configPath, "docker config", func(buf []byte, name string) (string, error) {
+		return r.persistDockerConfig(buf)
+	})(call)
+
+	// the new config is copied and merged
+	if arg := call.Argument(0); arg.IsString() || arg.IsObject() {
+		rg.Must0(r.mergeDockerRegistryCredentials())
+	}
+
+	return rg.Must(otto.ToValue(r.state.docker.configPath))
+}
+
+func (r *Runner) useDockerRegistries(call otto.FunctionCall) otto.Value {
+	var (
+		values []otto.Value
+		update bool
+	)
+	if first := call.Argument(0); first.IsNull() {
+		update = true
+	} else if first.IsObject() && first.Class() == "Array" {
+		obj := first.Object()
+		for _, key := range obj.Keys() {
+			values = append(values, rg.Must(obj.Get(key)))
+		}
+		update = true
+	} else {
+		values = call.ArgumentList
+	}
+
+	var registries []dockerRegistry
+	for _, val := range values {
+		var item dockerRegistry
+		if val.IsString() {
+			item.Registry = val.String()
+		} else if val.IsObject() && val.Class() == "Object" {
+			rg.Must0(json.Unmarshal(rg.Must(val.Object().MarshalJSON()), &item))
+		} else {
+			rg.Must0(fmt.Errorf("invalid docker registry %s, should be a string or an object", val.String()))
+		}
+		item.Registry = strings.TrimSuffix(item.Registry, "/")
+		rg.Must0(item.validate())
+		registries = append(registries, item)
+	}
+
+	if update || len(registries) > 0 {
+		r.state.docker.registries = registries
+
+		names := []string{}
+		for _, item := range registries {
+			names = append(names, item.Registry)
+		}
+		log.Printf("use docker registries: [%s]", strings.Join(names, ", "))
+
+		// credentials, never logged, previously merged ones are dropped
+		rg.Must0(r.mergeDockerRegistryCredentials())
+	}
+
+	names := []string{}
+	for _, item := range r.state.docker.registries {
+		names = append(names, item.Registry)
+	}
+	return rg.Must(fastjs.Array(r, names)).Value()
+}
@@ -0,0 +1,218 @@
+package fastci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yankeguo/fastci/pkg/fastregistry"
+)
+
+const (
+	fakeRegistryConfig   = `{"created":"2024-01-02T03:04:05Z","architecture":"arm64","os":"linux","config":{"Labels":{"team":"infra"}}}`
+	fakeRegistryManifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:6f7c6b87bbe0e11e2b0b9ddd3c4a3cde0e3e8ae3f4a5bc5b5ec8b4b2ad1e0fd1","size":10},"layers":[]}`
+)
+
+// newFakeRegistryForTest serves manifests, all blobs exist
+func newFakeRegistryForTest(t *testing.T) (host string, manifests map[string]string) {
+	var mu sync.Mutex
+	manifests = map[string]string{"staging/app:1.0": fakeRegistryManifest}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		p := strings.TrimPrefix(r.URL.Path, "/v2/")
+		if repo, ref, ok := strings.Cut(p, "/manifests/"); ok {
+			if r.Method == http.MethodPut {
+				buf, _ := io.ReadAll(r.Body)
+				manifests[repo+":"+ref] = string(buf)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			m, ok := manifests[repo+":"+ref]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(m))
+			return
+		}
+		if strings.Contains(p, "/blobs/") {
+			w.Write([]byte(fakeRegistryConfig))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(srv.Close)
+	host = strings.TrimPrefix(srv.URL, "http://")
+	return
+}
+
+func TestRunnerRegistryImages(t *testing.T) {
+	host, manifests := newFakeRegistryForTest(t)
+
+	sum := sha256.Sum256([]byte(fakeRegistryManifest))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	r := runnerForTest(t, `
+	useDockerConfig({content: {auths: {'`+host+`': {username: 'user', password: 'pass'}}}})
+	var res = tagImage('`+host+`/staging/app:1.0', 'stable', 'latest')
+	if (res.length !== 2 || res[0].image !== '`+host+`/staging/app:stable' || res[1].digest !== '`+digest+`') {
+		throw new Error('unexpected tag result: ' + JSON.stringify(res))
+	}
+	res = copyImage('`+host+`/staging/app:1.0', '`+host+`/prod/app:1.0')
+	if (res.reference !== '`+host+`/prod/app@`+digest+`') {
+		throw new Error('unexpected copy result: ' + JSON.stringify(res))
+	}
+	if (useDockerDigest('`+host+`/prod/app:1.0').digest !== '`+digest+`') {
+		throw new Error('digest not recorded')
+	}
+	var img = inspectImage('`+host+`/prod/app:1.0')
+	if (img.digest !== '`+digest+`' || img.platforms[0] !== 'linux/arm64' || img.labels.team !== 'infra' || img.created !== '2024-01-02T03:04:05Z') {
+		throw new Error('unexpected inspect result: ' + JSON.stringify(img))
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Equal(t, fakeRegistryManifest, manifests["staging/app:stable"])
+	require.Equal(t, fakeRegistryManifest, manifests["staging/app:latest"])
+	require.Equal(t, fakeRegistryManifest, manifests["prod/app:1.0"])
+}
+
+func TestRunnerTagImageInvalid(t *testing.T) {
+	r := NewRunner()
+	err := r.Execute(context.Background(), `tagImage('registry.example.com/app:1.0', ['bad/tag'])`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid tag "bad/tag"`)
+}
+
+func TestDockerRegistryMirror(t *testing.T) {
+	harbor := dockerRegistry{Registry: "harbor.example.com"}
+	require.Equal(t, "harbor.example.com/team/app:1", harbor.mirror("registry.cn-hangzhou.aliyuncs.com/team/app:1"))
+	require.Equal(t, "harbor.example.com/app:1", harbor.mirror("app:1"))
+	require.Equal(t, "harbor.example.com/library/ubuntu:24.04", harbor.mirror("library/ubuntu:24.04"))
+
+	prod := dockerRegistry{Registry: "localhost:5000/prod"}
+	require.Equal(t, "localhost:5000/prod/app:1", prod.mirror("registry.cn-hangzhou.aliyuncs.com/team/app:1"))
+	require.Equal(t, "localhost:5000/prod/app:1", prod.mirror("app:1"))
+
+	require.NoError(t, prod.validate())
+	require.Error(t, dockerRegistry{Registry: "team/app"}.validate())
+	require.Error(t, dockerRegistry{Registry: "harbor.example.com/Team"}.validate())
+	require.Error(t, dockerRegistry{Registry: "harbor.example.com", Username: "robot"}.validate())
+}
+
+func TestRunnerDockerRegistries(t *testing.T) {
+	dir := fakeDockerForTest(t)
+
+	r := runnerForTest(t, `
+	useDockerBackend('docker')
+	useDockerConfig({content: {auths: {'registry.cn-hangzhou.aliyuncs.com': {auth: 'YWxpeXVuOnNlY3JldA=='}}, credsStore: 'desktop'}})
+	useDockerImages('registry.cn-hangzhou.aliyuncs.com/team/app:1', 'registry.cn-hangzhou.aliyuncs.com/team/app:latest')
+	var registries = useDockerRegistries([
+		{registry: 'harbor.example.com/prod', username: 'robot', password: 'hunter2'},
+		'registry.cn-hangzhou.aliyuncs.com',
+	])
+	if (registries.length !== 2 || registries[0] !== 'harbor.example.com/prod') {
+		throw new Error('unexpected registries: ' + JSON.stringify(registries))
+	}
+	runDockerBuild()
+	var res = runDockerPush({concurrency: 1})
+	if (res.length !== 4 || res[3].image !== 'harbor.example.com/prod/app:latest' || res[3].status !== 'pushed') {
+		throw new Error('unexpected push result: ' + JSON.stringify(res))
+	}
+	if (useDockerDigest('harbor.example.com/prod/app:1') === undefined) {
+		throw new Error('unexpected digest of mirror')
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+
+	calls := fakeDockerCallsForTest(t, dir)
+	require.Len(t, calls, 5)
+	require.Contains(t, calls[0], " -t registry.cn-hangzhou.aliyuncs.com/team/app:1 -t registry.cn-hangzhou.aliyuncs.com/team/app:latest -t harbor.example.com/prod/app:1 -t harbor.example.com/prod/app:latest ")
+	require.True(t, strings.HasSuffix(calls[4], " push harbor.example.com/prod/app:latest"))
+
+	// credentials are merged into the docker config, other fields are kept
+	cfg, err := fastregistry.LoadDockerConfig(filepath.Join(r.state.docker.configPath, "config.json"))
+	require.NoError(t, err)
+	require.Equal(t, fastregistry.Credential{Username: "robot", Password: "hunter2"}, cfg.Credential("harbor.example.com"))
+	require.Equal(t, fastregistry.Credential{Username: "aliyun", Password: "secret"}, cfg.Credential("registry.cn-hangzhou.aliyuncs.com"))
+	buf, err := os.ReadFile(filepath.Join(r.state.docker.configPath, "config.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(buf), `"credsStore":"desktop"`)
+}
+
+func TestRunnerDockerRegistriesBeforeConfig(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"auths":{"ghcr.io":{"auth":"Z2g6dG9rZW4="}}}`), 0600))
+
+	r := runnerForTest(t, `
+	useDockerRegistries({registry: 'harbor.example.com', username: 'robot', password: 'hunter2'})
+	useDockerConfig({content: {auths: {}}})
+	useDockerImages('app:1')
+	`)
+	defer clearRunnerForTest(t, r)
+
+	file := filepath.Join(r.state.docker.configPath, "config.json")
+	cfg, err := fastregistry.LoadDockerConfig(file)
+	require.NoError(t, err)
+	require.Equal(t, "robot", cfg.Credential("harbor.example.com").Username)
+	require.Equal(t, []string{"app:1", "harbor.example.com/app:1"}, r.resolveDockerImages())
+
+	// credentials are only accessible by the current user
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(r.state.docker.configPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// a config from path is copied and merged, the original file is untouched
+	r2 := runnerForTest(t, `
+	useDockerRegistries({registry: 'harbor.example.com', username: 'robot', password: 'hunter2'})
+	if (useDockerConfig({path: '`+dir+`'}) === '`+dir+`') {
+		throw new Error('unexpected docker config of path')
+	}
+	`)
+	defer clearRunnerForTest(t, r2)
+
+	cfg, err = fastregistry.LoadDockerConfig(filepath.Join(r2.state.docker.configPath, "config.json"))
+	require.NoError(t, err)
+	require.Equal(t, "robot", cfg.Credential("harbor.example.com").Username)
+	require.Equal(t, "gh", cfg.Credential("ghcr.io").Username)
+
+	buf, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	require.NoError(t, err)
+	require.NotContains(t, string(buf), "harbor.example.com")
+}
+
+func TestRunnerDockerRegistriesReset(t *testing.T) {
+	r := runnerForTest(t, `
+	var base = useDockerConfig({content: {auths: {}}})
+	useDockerRegistries({registry: 'harbor.example.com', username: 'robot', password: 'hunter2'})
+	if (useDockerConfig() === base) {
+		throw new Error('expected merged docker config')
+	}
+	useDockerRegistries(null)
+	if (useDockerConfig() !== base) {
+		throw new Error('expected base docker config')
+	}
+	useDockerRegistries({registry: 'quay.example.com', username: 'bot', password: 'secret'})
+	`)
+	defer clearRunnerForTest(t, r)
+
+	// credentials of the replaced registries are dropped
+	cfg, err := fastregistry.LoadDockerConfig(filepath.Join(r.state.docker.configPath, "config.json"))
+	require.NoError(t, err)
+	require.Equal(t, "bot", cfg.Credential("quay.example.com").Username)
+	require.Empty(t, cfg.Credential("harbor.example.com").Username)
+}
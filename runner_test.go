@@ -99,3 +99,127 @@ func TestRunnerResolveCodingCredentials(t *testing.T) {
 	require.Equal(t, "hello", username)
 	require.Equal(t, "world", password)
 }
+
+func TestRunnerRunScriptCapture(t *testing.T) {
+	r := runnerForTest(t, `
+	useScript('echo hello; echo world >&2')
+	var res = runScript({capture: true})
+	if (res.stdout !== 'hello\n' || res.stderr !== 'world\n' || res.exitCode !== 0 || typeof res.durationMs !== 'number') {
+		throw new Error('unexpected result: ' + JSON.stringify(res))
+	}
+	if (runScript() !== null) {
+		throw new Error('expected null')
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+}
+
+func TestRunnerRunScriptAllowFailure(t *testing.T) {
+	r := runnerForTest(t, `
+	useScript('echo failed; exit 4')
+	var res = runScript({capture: true, allowFailure: true})
+	if (res.stdout !== 'failed\n' || res.exitCode !== 4) {
+		throw new Error('unexpected result: ' + JSON.stringify(res))
+	}
+	res = runScript({allowFailure: true})
+	if (res.stdout !== undefined || res.exitCode !== 4) {
+		throw new Error('unexpected result: ' + JSON.stringify(res))
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+}
+
+func TestRunnerExec(t *testing.T) {
+	dir := t.TempDir()
+	r := runnerForTest(t, `
+	useEnv('GREETING', 'hello')
+	var res = exec(['sh', '-c', 'echo "$GREETING $NAME $(pwd)"; cat', 'it\'s "quoted"'], {
+		cwd: '`+dir+`',
+		env: {NAME: 'world'},
+		stdin: 'from stdin',
+		capture: true,
+	})
+	if (res.stdout !== 'hello world `+dir+`\nfrom stdin' || res.exitCode !== 0) {
+		throw new Error('unexpected result: ' + JSON.stringify(res))
+	}
+	res = exec(['printf', '%s', 'it\'s "quoted" $HOME'], {capture: true})
+	if (res.stdout !== 'it\'s "quoted" $HOME') {
+		throw new Error('unexpected result: ' + JSON.stringify(res))
+	}
+	res = exec(['false'], {allowFailure: true})
+	if (res.exitCode !== 1 || res.stdout !== undefined) {
+		throw new Error('unexpected result: ' + JSON.stringify(res))
+	}
+	try {
+		exec(['sleep', '30'], {timeout: '100ms'})
+		throw new Error('expected timeout')
+	} catch (e) {
+		if (e.name !== 'TimeoutError') {
+			throw e
+		}
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+}
+
+func TestRunnerExecInvalid(t *testing.T) {
+	err := NewRunner().Execute(context.Background(), `exec('echo hello')`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exec requires a non-empty array")
+}
+
+func TestRunnerNamedScriptAmbiguous(t *testing.T) {
+	err := NewRunner().Execute(context.Background(), `useScript('build', 'make')`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `ambiguous useScript("build", "make"), use useScript("build", [...])`)
+
+	// lines of the default script
+	r := runnerForTest(t, `useScript('set -e', 'make build')`)
+	defer clearRunnerForTest(t, r)
+	buf, err := os.ReadFile(r.state.script.path)
+	require.NoError(t, err)
+	require.Equal(t, "set -e\nmake build", string(buf))
+
+	// three or more lines are never a named script
+	r = runnerForTest(t, `useScript('pwd', 'ls -d /', 'date')`)
+	defer clearRunnerForTest(t, r)
+	buf, err = os.ReadFile(r.state.script.path)
+	require.NoError(t, err)
+	require.Equal(t, "pwd\nls -d /\ndate", string(buf))
+	require.Empty(t, r.state.script.named)
+}
+
+func TestRunnerNamedScripts(t *testing.T) {
+	r := runnerForTest(t, `
+	useEnv('STAGE', 'default')
+	useScript('echo default $STAGE $0')
+	useScript('test', ['echo test', 'echo $STAGE'])
+	useScript('build', {
+		content: 'echo build $STAGE $0',
+		shell: ['sh'],
+		env: {STAGE: 'build'},
+	})
+
+	var res = runScript('test', {capture: true})
+	if (res.stdout !== 'test\ndefault\n') {
+		throw new Error('unexpected test output: ' + res.stdout)
+	}
+	res = runScript('build', {capture: true})
+	if (res.stdout !== 'build build sh\n') {
+		throw new Error('unexpected build output: ' + res.stdout)
+	}
+	res = runScript({capture: true})
+	if (res.stdout !== 'default default bash\n') {
+		throw new Error('unexpected default output: ' + res.stdout)
+	}
+	try {
+		runScript('migrate')
+		throw new Error('expected error')
+	} catch (e) {
+		if (e.message.indexOf('script migrate is not defined') < 0) {
+			throw e
+		}
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+}
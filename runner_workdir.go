@@ -0,0 +1,55 @@
+package fastci
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/robertkrimen/otto"
+	"github.com/yankeguo/rg"
+)
+
+// resolvePath resolves a relative path against the working directory
+func (r *Runner) resolvePath(p string) string {
+	if p == "" || r.state.workdir == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(r.state.workdir, p)
+}
+
+// resolveWorkdir resolves an existing directory against the workdir
+func (r *Runner) resolveWorkdir(dir string) (out string, err error) {
+	if out, err = filepath.Abs(r.resolvePath(dir)); err != nil {
+		return
+	}
+	var info os.FileInfo
+	if info, err = os.Stat(out); err != nil {
+		return
+	}
+	if !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", out)
+		return
+	}
+	return
+}
+
+// currentWorkdir returns the absolute working directory
+func (r *Runner) currentWorkdir() (dir string, err error) {
+	if r.state.workdir != "" {
+		dir = r.state.workdir
+		return
+	}
+	return os.Getwd()
+}
+
+func (r *Runner) useWorkdir(call otto.FunctionCall) otto.Value {
+	if arg := call.Argument(0); arg.IsNull() {
+		r.state.workdir = ""
+		log.Println("use workdir: current directory")
+	} else if arg.IsString() {
+		r.state.workdir = rg.Must(r.resolveWorkdir(arg.String()))
+		log.Println("use workdir:", r.state.workdir)
+	}
+	return rg.Must(otto.ToValue(rg.Must(r.currentWorkdir())))
+}
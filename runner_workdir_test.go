@@ -0,0 +1,83 @@
+package fastci
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunnerUseWorkdir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "svc-a"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "svc-a", "build.sh"), []byte("echo built in $(pwd)"), 0644))
+
+	r := runnerForTest(t, `
+	if (useWorkdir('`+dir+`') !== '`+dir+`') {
+		throw new Error('unexpected workdir: ' + useWorkdir())
+	}
+
+	var res = exec(['pwd'], {capture: true})
+	if (res.stdout !== '`+dir+`\n') {
+		throw new Error('unexpected exec pwd: ' + res.stdout)
+	}
+
+	// relative path resolved against workdir, per-step cwd resolved against workdir
+	useScript({path: 'svc-a/build.sh'})
+	res = runScript({capture: true})
+	if (res.stdout !== 'built in `+dir+`\n') {
+		throw new Error('unexpected script output: ' + res.stdout)
+	}
+	useScript({path: 'build.sh'})
+	res = runScript({capture: true, cwd: 'svc-a'})
+	if (res.stdout !== 'built in `+dir+`/svc-a\n') {
+		throw new Error('unexpected script output: ' + res.stdout)
+	}
+	if (useWorkdir() !== '`+dir+`') {
+		throw new Error('workdir not restored: ' + useWorkdir())
+	}
+
+	editYamlFile('svc-a/values.yaml', function (m) {
+		m.image = 'app:1'
+	})
+
+	useWorkdir('svc-a')
+	if (useWorkdir() !== '`+dir+`/svc-a') {
+		throw new Error('unexpected workdir: ' + useWorkdir())
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+
+	buf, err := os.ReadFile(filepath.Join(dir, "svc-a", "values.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "image: app:1\n", string(buf))
+}
+
+func TestRunnerUseWorkdirMissing(t *testing.T) {
+	err := NewRunner().Execute(context.Background(), `useWorkdir('`+t.TempDir()+`/missing')`)
+	require.Error(t, err)
+}
+
+func TestRunnerUseWorkdirDockerBuild(t *testing.T) {
+	fake := fakeDockerForTest(t)
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "svc-b"), 0755))
+
+	r := runnerForTest(t, `
+	useWorkdir('`+dir+`')
+	useDockerImages('app:1')
+	useDockerfile({path: 'svc-b/Dockerfile'})
+	useDockerBuildContext('svc-b')
+	runDockerBuild()
+	`)
+	defer clearRunnerForTest(t, r)
+
+	args := fakeDockerArgsForTest(t, fake)
+	require.Equal(t, []string{"-f", dir + "/svc-b/Dockerfile", dir + "/svc-b"}, args[len(args)-3:])
+
+	buf, err := os.ReadFile(filepath.Join(fake, "pwd"))
+	require.NoError(t, err)
+	require.Equal(t, dir+"\n", string(buf))
+}
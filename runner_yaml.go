@@ -0,0 +1,167 @@
+package fastci
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/robertkrimen/otto"
+	"github.com/yankeguo/fastci/pkg/fastjs"
+	"github.com/yankeguo/fastci/pkg/fastyaml"
+	"github.com/yankeguo/rg"
+)
+
+// exportValue converts a JavaScript value to plain Go value via JSON
+func (r *Runner) exportValue(val otto.Value) (out any, err error) {
+	if val.IsUndefined() {
+		return
+	}
+	var s otto.Value
+	if s, err = r.vm.Call("JSON.stringify", nil, val); err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(s.String()), &out)
+	return
+}
+
+// importValue converts a plain Go value to JavaScript value via JSON
+func (r *Runner) importValue(val any) (out otto.Value, err error) {
+	var buf []byte
+	if buf, err = json.Marshal(val); err != nil {
+		return
+	}
+	return r.vm.Call("JSON.parse", nil, string(buf))
+}
+
+// exportYamlPath converts a JavaScript string path or array path to fastyaml.Path
+func (r *Runner) exportYamlPath(val otto.Value) (p fastyaml.Path, err error) {
+	if val.IsString() {
+		return fastyaml.ParsePath(val.String())
+	}
+	if !val.IsObject() || val.Class() != "Array" {
+		err = errors.New("yaml path should be a string or an array")
+		return
+	}
+	var items []any
+	var raw any
+	if raw, err = r.exportValue(val); err != nil {
+		return
+	}
+	items, _ = raw.([]any)
+	for _, item := range items {
+		switch v := item.(type) {
+		case float64:
+			p = append(p, int(v))
+		case string:
+			p = append(p, v)
+		default:
+			err = errors.New("yaml path element should be a string or a number")
+			return
+		}
+	}
+	return
+}
+
+// createYamlDocumentObject wraps the document for JavaScript
+func (r *Runner) createYamlDocumentObject(doc *fastyaml.Document) (obj *otto.Object, err error) {
+	return fastjs.Object(r, map[string]any{
+		"get": func(call otto.FunctionCall) otto.Value {
+			p := rg.Must(r.exportYamlPath(call.Argument(0)))
+			val, exists := rg.Must2(doc.Get(p))
+			if !exists {
+				return otto.UndefinedValue()
+			}
+			return rg.Must(r.importValue(rg.Must(fastyaml.Normalize(val))))
+		},
+		"set": func(call otto.FunctionCall) otto.Value {
+			p := rg.Must(r.exportYamlPath(call.Argument(0)))
+			rg.Must0(doc.Set(p, rg.Must(r.exportValue(call.Argument(1)))))
+			return call.Argument(1)
+		},
+		"delete": func(call otto.FunctionCall) otto.Value {
+			p := rg.Must(r.exportYamlPath(call.Argument(0)))
+			return rg.Must(otto.ToValue(rg.Must(doc.Delete(p))))
+		},
+		"insert": func(call otto.FunctionCall) otto.Value {
+			p := rg.Must(r.exportYamlPath(call.Argument(0)))
+			index, val := -1, call.Argument(1)
+			if len(call.ArgumentList) > 2 {
+				index = int(rg.Must(call.Argument(1).ToInteger()))
+				val = call.Argument(2)
+			}
+			rg.Must0(doc.Insert(p, index, rg.Must(r.exportValue(val))))
+			return val
+		},
+		"toString": func(call otto.FunctionCall) otto.Value {
+			return rg.Must(otto.ToValue(string(rg.Must(doc.Bytes()))))
+		},
+	})
+}
+
+// editYaml edits the YAML source with minimal diff
+func (r *Runner) editYaml(buf []byte, fn otto.Value) (out []byte, changed bool, err error) {
+	defer rg.Guard(&err)
+
+	doc := rg.Must(fastyaml.Parse(buf))
+
+	old := rg.Must(fastyaml.Normalize(rg.Must(doc.Value())))
+
+	val := rg.Must(r.importValue(old))
+
+	if fn.IsFunction() {
+		obj := rg.Must(r.createYamlDocumentObject(doc))
+		if ret := rg.Must(fn.Call(otto.NullValue(), val, obj)); ret.IsObject() && ret != obj.Value() {
+			val = ret
+		}
+	}
+
+	rg.Must0(doc.Apply(old, rg.Must(r.exportValue(val))))
+
+	if !doc.Dirty() {
+		out = buf
+		return
+	}
+
+	out = rg.Must(doc.Bytes())
+	changed = !bytes.Equal(buf, out)
+	return
+}
+
+// patchYamlFile edits the YAML file, returns if changed
+func (r *Runner) patchYamlFile(file string, fn otto.Value) (changed bool, err error) {
+	defer rg.Guard(&err)
+
+	var buf []byte
+	if buf, err = os.ReadFile(file); err != nil {
+		if !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+
+	var out []byte
+	if out, changed = rg.Must2(r.editYaml(buf, fn)); !changed {
+		return
+	}
+
+	rg.Must0(os.MkdirAll(filepath.Dir(file), 0755))
+	rg.Must0(os.WriteFile(file, out, 0644))
+	return
+}
+
+func (r *Runner) editYamlFile(call otto.FunctionCall) otto.Value {
+	file := call.Argument(0).String()
+
+	changed := rg.Must(r.patchYamlFile(r.resolvePath(file), call.Argument(1)))
+
+	if changed {
+		log.Println("yaml file updated:", file)
+	} else {
+		log.Println("yaml file not changed:", file)
+	}
+
+	return rg.Must(otto.ToValue(changed))
+}
@@ -0,0 +1,62 @@
+package fastci
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yankeguo/rg"
+)
+
+func TestRunnerEditYamlFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "values.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`# values for app
+app:
+  image: app:1 # updated by fastci
+  hosts:
+    - a.example.com
+`), 0644))
+
+	r := runnerForTest(t, `
+	var changed = editYamlFile('`+file+`', function (m, doc) {
+		m.app.image = 'app:2'
+		doc.insert('app.hosts', 'b.example.com')
+		doc.set(['app', 'labels', 'team.io/name'], 'infra')
+		if (doc.get('app.hosts[0]') !== 'a.example.com') {
+			throw new Error('unexpected host')
+		}
+	})
+	if (!changed) {
+		throw new Error('changed expected')
+	}
+	if (editYamlFile('`+file+`', function (m) {})) {
+		throw new Error('no change expected')
+	}
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Equal(t, `# values for app
+app:
+  image: app:2 # updated by fastci
+  hosts:
+    - a.example.com
+    - b.example.com
+  labels:
+    team.io/name: infra
+`, string(rg.Must(os.ReadFile(file))))
+}
+
+func TestRunnerEditYamlFileReturn(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sub", "new.yaml")
+
+	r := runnerForTest(t, `
+	editYamlFile('`+file+`', function (m, doc) {
+		doc.delete('missing')
+		return {hello: 'world'}
+	})
+	`)
+	defer clearRunnerForTest(t, r)
+
+	require.Equal(t, "hello: world\n", string(rg.Must(os.ReadFile(file))))
+}
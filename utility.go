@@ -3,6 +3,7 @@ package fastci
 import (
 	"encoding/json"
 	"errors"
+	"net/url"
 	"regexp"
 	"strings"
 
@@ -17,6 +18,16 @@ func cleanEnvKey(name string) string {
 	return nonAlphaNumeric.ReplaceAllString(strings.ToUpper(name), "_")
 }
 
+// stripURLCredentials removes the username and password from a url
+func stripURLCredentials(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = nil
+	return u.String()
+}
+
 func toYaml(buf []byte) (out []byte, err error) {
 	// test if it's already a valid yaml
 	{